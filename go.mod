@@ -10,7 +10,6 @@ require (
 	github.com/open-uem/ent v0.0.0-20251017131532-38c6f9d2010c
 	github.com/open-uem/nats v0.0.0-20251017130656-df38cff592ee
 	github.com/open-uem/utils v0.0.0-20251014101747-824dc3574744
-	github.com/zcalusic/sysinfo v1.1.3
 	golang.org/x/sys v0.37.0
 	gopkg.in/ini.v1 v1.67.0
 )
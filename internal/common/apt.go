@@ -0,0 +1,129 @@
+//go:build linux
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// AptPackageManager installs OpenUEM on Debian based distributions. The
+// openuem-server meta package pulls the components that are installed
+type AptPackageManager struct{}
+
+func (pm *AptPackageManager) Name() string {
+	return "apt"
+}
+
+func (pm *AptPackageManager) InstalledComponents() []string {
+	return []string{"openuem-server"}
+}
+
+func (pm *AptPackageManager) IsVersionAvailable(name string, version string) (bool, error) {
+	out, err := runQuery("apt-cache", "madison", name)
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) > 1 && strings.TrimSpace(fields[1]) == version {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (pm *AptPackageManager) Install(packages []Package, allowDowngrade bool, output io.Writer) error {
+	if err := runInstall(output, "apt-get", "update"); err != nil {
+		return err
+	}
+
+	args := []string{"install", "-y"}
+	if allowDowngrade {
+		args = append(args, "--allow-downgrades")
+	}
+	for _, p := range packages {
+		args = append(args, fmt.Sprintf("%s=%s", p.Name, p.Version))
+	}
+	return runInstall(output, "apt-get", args...)
+}
+
+func (pm *AptPackageManager) Simulate(packages []Package) (*Transaction, error) {
+	args := []string{"-s", "install", "--allow-downgrades"}
+	for _, p := range packages {
+		args = append(args, fmt.Sprintf("%s=%s", p.Name, p.Version))
+	}
+
+	out, err := runSimulation("apt-get", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	t := Transaction{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "Inst "):
+			// Inst openuem-console [0.8.0] (0.9.0 OpenUEM:stable [amd64])
+			fields := strings.Fields(line)
+			change := PackageChange{Name: fields[1]}
+			for i, f := range fields[2:] {
+				if strings.HasPrefix(f, "[") && change.From == "" && i == 0 {
+					change.From = strings.Trim(f, "[]")
+				}
+				if strings.HasPrefix(f, "(") {
+					change.To = strings.TrimPrefix(f, "(")
+					break
+				}
+			}
+			t.Packages = append(t.Packages, change)
+		case strings.HasPrefix(line, "Need to get "):
+			t.DownloadSize, _, _ = strings.Cut(strings.TrimPrefix(line, "Need to get "), " of archives")
+		case strings.HasPrefix(line, "E: "), strings.Contains(line, "but it is not going to be installed"), strings.Contains(line, " Conflicts: "), strings.Contains(line, " Breaks: "):
+			t.Conflicts = append(t.Conflicts, line)
+		}
+	}
+
+	return &t, nil
+}
+
+func (pm *AptPackageManager) CheckLocks() error {
+	for _, path := range []string{"/var/lib/dpkg/lock-frontend", "/var/lib/dpkg/lock", "/var/lib/apt/lists/lock"} {
+		if err := fcntlLocked(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pm *AptPackageManager) InstalledVersion(name string) (string, error) {
+	return runQuery("dpkg-query", "-W", "-f=${Version}", name)
+}
+
+func (pm *AptPackageManager) RepositoryFiles() []string {
+	return []string{"/etc/apt/sources.list.d/openuem.list", "/etc/apt/sources.list.d/openuem.sources"}
+}
+
+func (pm *AptPackageManager) Refresh(output io.Writer) error {
+	return runInstall(output, "apt-get", "update")
+}
+
+func (pm *AptPackageManager) LatestVersion(name string) (string, error) {
+	out, err := runQuery("apt-cache", "policy", name)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		if candidate, found := strings.CutPrefix(strings.TrimSpace(line), "Candidate:"); found {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "(none)" {
+				break
+			}
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("the repository doesn't offer %s", name)
+}
@@ -0,0 +1,202 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/open-uem/ent/server"
+	"github.com/open-uem/openuem-server-updater/internal/models"
+	"gopkg.in/ini.v1"
+)
+
+// The auto-update policy lets a server follow its channel without requests
+// from the console. Each policy allows the updates of the previous one
+const (
+	AUTO_UPDATE_OFF       = "off"
+	AUTO_UPDATE_PATCH     = "patch"
+	AUTO_UPDATE_MINOR     = "minor"
+	AUTO_UPDATE_ANY       = "any"
+	AUTO_UPDATE_REQUESTER = "auto-update"
+)
+
+type AutoUpdatePolicy struct {
+	Mode string
+	// Hour and Minute are the preferred time to update, if Preferred is
+	// false updates are scheduled as soon as the release is old enough
+	Preferred bool
+	Hour      int
+	Minute    int
+	// Delay is how long a release must have been available before it's
+	// installed, it's measured from its publication date if the release
+	// manifest has it or from when this server first detected the release
+	Delay time.Duration
+}
+
+// ParseAutoUpdatePolicy reads the auto-update keys of the [Updates] section, e.g.
+//
+//	AutoUpdate = patch
+//	AutoUpdateTime = 03:30
+//	AutoUpdateDelay = 72h
+//
+// Auto-updates are not available on Windows as the installer to download
+// must come with the update request
+func ParseAutoUpdatePolicy(section *ini.Section) (*AutoUpdatePolicy, error) {
+	policy := AutoUpdatePolicy{
+		Mode:  section.Key("AutoUpdate").MustString(AUTO_UPDATE_OFF),
+		Delay: section.Key("AutoUpdateDelay").MustDuration(0),
+	}
+
+	if !slices.Contains([]string{AUTO_UPDATE_OFF, AUTO_UPDATE_PATCH, AUTO_UPDATE_MINOR, AUTO_UPDATE_ANY}, policy.Mode) {
+		return nil, fmt.Errorf("auto-update policy %q is not valid, use off, patch, minor or any", policy.Mode)
+	}
+
+	if policy.Mode != AUTO_UPDATE_OFF && runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("auto-update policy %q is not supported on Windows, use off", policy.Mode)
+	}
+
+	if policy.Delay < 0 {
+		return nil, fmt.Errorf("auto-update delay %s must not be negative", policy.Delay)
+	}
+
+	if preferred := section.Key("AutoUpdateTime").String(); preferred != "" {
+		t, err := time.Parse("15:04", preferred)
+		if err != nil {
+			return nil, fmt.Errorf("auto-update time %q is not valid, use HH:MM", preferred)
+		}
+		policy.Preferred = true
+		policy.Hour = t.Hour()
+		policy.Minute = t.Minute()
+	}
+
+	return &policy, nil
+}
+
+// Allows reports if the policy installs the version over the installed one
+// on its own. Versions that are not semantic versions are never installed
+func (p *AutoUpdatePolicy) Allows(installed string, version string) bool {
+	if p == nil || p.Mode == AUTO_UPDATE_OFF {
+		return false
+	}
+
+	v, err := ParseSemVer(version)
+	if err != nil {
+		return false
+	}
+
+	i, err := ParseSemVer(installed)
+	if err != nil || v.Compare(i) <= 0 {
+		return false
+	}
+
+	switch p.Mode {
+	case AUTO_UPDATE_PATCH:
+		return v.Major == i.Major && v.Minor == i.Minor
+	case AUTO_UPDATE_MINOR:
+		return v.Major == i.Major
+	}
+	return true
+}
+
+// UpdateTime returns when a release published or detected at the given time
+// can be installed, the preferred time uses the time zone of the maintenance
+// windows
+func (p *AutoUpdatePolicy) UpdateTime(releasedAt time.Time, now time.Time, location *time.Location) time.Time {
+	t := releasedAt.Add(p.Delay)
+	if t.Before(now) {
+		t = now
+	}
+
+	if !p.Preferred {
+		return t
+	}
+
+	if location == nil {
+		location = time.Local
+	}
+
+	t = t.In(location)
+	preferred := time.Date(t.Year(), t.Month(), t.Day(), p.Hour, p.Minute, 0, 0, location)
+	if preferred.Before(t) {
+		preferred = preferred.AddDate(0, 0, 1)
+	}
+	return preferred
+}
+
+// ApplyAutoUpdatePolicy schedules the update to the latest version if the
+// policy allows it. The update is stored like a scheduled console request so
+// it follows the same path and is recorded the same way. A version is only
+// scheduled once, if it fails the console must request it
+func (us *UpdaterService) ApplyAutoUpdatePolicy(latest string, channel server.Channel, releasedAt time.Time) {
+	if !us.AutoUpdate.Allows(us.Version, latest) {
+		return
+	}
+
+	for _, p := range us.PendingUpdates() {
+		if p.Version == latest {
+			return
+		}
+	}
+
+	state, err := LoadUpdateState()
+	if err != nil || state != nil {
+		return
+	}
+
+	hostname, err := models.GetHostname()
+	if err != nil {
+		log.Printf("[ERROR]: could not get hostname, reason: %v", err)
+		return
+	}
+
+	history, err := us.Model.GetUpdateHistoryByHost(hostname)
+	if err != nil {
+		log.Printf("[ERROR]: could not get update history, reason: %v", err)
+		return
+	}
+	if slices.ContainsFunc(history, func(h models.UpdateHistory) bool {
+		return h.RequestedBy == AUTO_UPDATE_REQUESTER && h.Version == latest
+	}) {
+		return
+	}
+
+	var location *time.Location
+	if us.Maintenance != nil {
+		location = us.Maintenance.Location
+	}
+
+	data := UpdateRequest{RequestedBy: AUTO_UPDATE_REQUESTER}
+	data.Version = latest
+	data.Channel = string(channel)
+	data.UpdateAt = us.AutoUpdate.UpdateTime(releasedAt, time.Now(), location)
+
+	// Auto-updates must respect the maintenance windows too
+	if us.Maintenance != nil {
+		slot, err := us.Maintenance.NextSlot(data.UpdateAt)
+		if err != nil {
+			log.Printf("[ERROR]: could not schedule auto-update to %s, reason: %v", latest, err)
+			return
+		}
+		data.UpdateAt = slot
+	}
+
+	if _, err := us.ValidateUpdateRequest(data); err != nil {
+		log.Printf("[ERROR]: could not schedule auto-update to %s, reason: %v", latest, err)
+		return
+	}
+
+	if _, err := us.CheckVersionPolicy(data, channel); err != nil {
+		log.Printf("[ERROR]: auto-update to %s refused by the version policy, reason: %v", latest, err)
+		return
+	}
+
+	if err := us.SchedulePendingUpdate(data, channel, 0); err != nil {
+		log.Printf("[ERROR]: could not schedule auto-update to %s, reason: %v", latest, err)
+		return
+	}
+
+	log.Printf("[INFO]: auto-update to %s scheduled at %s", latest, data.UpdateAt.String())
+	us.PublishUpdateEvent(UpdatePhaseScheduled, latest, channel, "auto-update scheduled at "+data.UpdateAt.String())
+}
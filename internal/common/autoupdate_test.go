@@ -0,0 +1,187 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/open-uem/ent/server"
+	"gopkg.in/ini.v1"
+)
+
+func TestParseAutoUpdatePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    AutoUpdatePolicy
+		wantErr bool
+	}{
+		{name: "default", want: AutoUpdatePolicy{Mode: AUTO_UPDATE_OFF}},
+		{
+			name:   "patch at a preferred time",
+			config: "AutoUpdate = patch\nAutoUpdateTime = 03:30\nAutoUpdateDelay = 72h\n",
+			want:   AutoUpdatePolicy{Mode: AUTO_UPDATE_PATCH, Preferred: true, Hour: 3, Minute: 30, Delay: 72 * time.Hour},
+		},
+		{name: "invalid mode", config: "AutoUpdate = always\n", wantErr: true},
+		{name: "invalid time", config: "AutoUpdate = minor\nAutoUpdateTime = 25:00\n", wantErr: true},
+		{name: "negative delay", config: "AutoUpdate = any\nAutoUpdateDelay = -1h\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ini.Load([]byte("[Updates]\n" + tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The installer of an auto-update can't be known on Windows
+			wantErr := tt.wantErr || (runtime.GOOS == "windows" && tt.want.Mode != AUTO_UPDATE_OFF)
+
+			policy, err := ParseAutoUpdatePolicy(cfg.Section("Updates"))
+			if (err != nil) != wantErr {
+				t.Fatalf("ParseAutoUpdatePolicy() error = %v, wantErr %v", err, wantErr)
+			}
+			if err == nil && *policy != tt.want {
+				t.Errorf("ParseAutoUpdatePolicy() = %+v, want %+v", *policy, tt.want)
+			}
+		})
+	}
+}
+
+func TestAutoUpdatePolicyAllows(t *testing.T) {
+	tests := []struct {
+		mode      string
+		installed string
+		version   string
+		want      bool
+	}{
+		{mode: AUTO_UPDATE_OFF, installed: "0.8.0", version: "0.8.1", want: false},
+		{mode: AUTO_UPDATE_PATCH, installed: "0.8.0", version: "0.8.1", want: true},
+		{mode: AUTO_UPDATE_PATCH, installed: "0.8.0", version: "0.9.0", want: false},
+		{mode: AUTO_UPDATE_MINOR, installed: "0.8.0", version: "0.9.0", want: true},
+		{mode: AUTO_UPDATE_MINOR, installed: "0.8.0", version: "1.0.0", want: false},
+		{mode: AUTO_UPDATE_ANY, installed: "0.8.0", version: "1.0.0", want: true},
+		{mode: AUTO_UPDATE_ANY, installed: "0.8.0", version: "0.8.0", want: false},
+		{mode: AUTO_UPDATE_ANY, installed: "0.8.1", version: "0.8.0", want: false},
+		{mode: AUTO_UPDATE_ANY, installed: "0.8.0", version: "latest", want: false},
+		{mode: AUTO_UPDATE_ANY, installed: "", version: "0.8.0", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode+"_"+tt.installed+"_"+tt.version, func(t *testing.T) {
+			p := &AutoUpdatePolicy{Mode: tt.mode}
+			if got := p.Allows(tt.installed, tt.version); got != tt.want {
+				t.Errorf("Allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	var p *AutoUpdatePolicy
+	if p.Allows("0.8.0", "0.8.1") {
+		t.Error("a nil policy allowed an update")
+	}
+}
+
+func TestAutoUpdatePolicyUpdateTime(t *testing.T) {
+	location := time.UTC
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, location)
+
+	tests := []struct {
+		name       string
+		policy     AutoUpdatePolicy
+		releasedAt time.Time
+		want       time.Time
+	}{
+		{
+			name:       "no delay",
+			releasedAt: now.Add(-time.Hour),
+			want:       now,
+		},
+		{
+			name:       "delay not elapsed",
+			policy:     AutoUpdatePolicy{Delay: 72 * time.Hour},
+			releasedAt: now.Add(-24 * time.Hour),
+			want:       now.Add(48 * time.Hour),
+		},
+		{
+			name:       "delay elapsed",
+			policy:     AutoUpdatePolicy{Delay: 72 * time.Hour},
+			releasedAt: now.Add(-96 * time.Hour),
+			want:       now,
+		},
+		{
+			name:       "preferred time later today",
+			policy:     AutoUpdatePolicy{Preferred: true, Hour: 23, Minute: 30},
+			releasedAt: now,
+			want:       time.Date(2026, 3, 10, 23, 30, 0, 0, location),
+		},
+		{
+			name:       "preferred time already passed",
+			policy:     AutoUpdatePolicy{Preferred: true, Hour: 3, Minute: 30},
+			releasedAt: now,
+			want:       time.Date(2026, 3, 11, 3, 30, 0, 0, location),
+		},
+		{
+			name:       "preferred time after the delay",
+			policy:     AutoUpdatePolicy{Preferred: true, Hour: 3, Minute: 30, Delay: 48 * time.Hour},
+			releasedAt: now,
+			want:       time.Date(2026, 3, 13, 3, 30, 0, 0, location),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.UpdateTime(tt.releasedAt, now, location); !got.Equal(tt.want) {
+				t.Errorf("UpdateTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManifestLatestVersion(t *testing.T) {
+	published := time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		index         string
+		wantVersion   string
+		wantPublished time.Time
+	}{
+		{
+			name:          "publication date",
+			index:         `{"channels":{"stable":"0.8.0"},"published":{"0.8.0":"2026-03-02T10:00:00Z"}}`,
+			wantVersion:   "0.8.0",
+			wantPublished: published,
+		},
+		{
+			name:        "no publication date",
+			index:       `{"channels":{"stable":"0.8.0"}}`,
+			wantVersion: "0.8.0",
+		},
+		{
+			name:        "publication date of another version",
+			index:       `{"channels":{"stable":"0.8.0"},"published":{"0.7.0":"2026-02-02T10:00:00Z"}}`,
+			wantVersion: "0.8.0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.index))
+			}))
+			defer ts.Close()
+
+			us := &UpdaterService{ManifestURL: ts.URL}
+			version, publishedAt, err := us.ManifestLatestVersion(server.ChannelStable)
+			if err != nil {
+				t.Fatalf("ManifestLatestVersion() error = %v", err)
+			}
+			if version != tt.wantVersion || !publishedAt.Equal(tt.wantPublished) {
+				t.Errorf("ManifestLatestVersion() = %s, %v, want %s, %v", version, publishedAt, tt.wantVersion, tt.wantPublished)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/open-uem/ent/server"
+	"github.com/open-uem/openuem-server-updater/internal/models"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	AVAILABILITY_DEFAULT_CHECK_INTERVAL = 6 * time.Hour
+	AVAILABILITY_SOURCE_MANIFEST        = "manifest"
+	AVAILABILITY_SOURCE_REPOSITORY      = "repository"
+)
+
+// ReleaseIndex is the document served at the release manifest URL with the
+// newest version of every channel and optionally when each version was published
+type ReleaseIndex struct {
+	Channels  map[string]string    `json:"channels"`
+	Published map[string]time.Time `json:"published,omitempty"`
+}
+
+// ReadUpdatesConfig reads the optional [Updates] section. The newest version
+// is read from the release manifest if ManifestURL is set or from the
+// repository otherwise
+func (us *UpdaterService) ReadUpdatesConfig(cfg *ini.File) error {
+	section := cfg.Section("Updates")
+
+	us.ManifestURL = section.Key("ManifestURL").String()
+	us.AvailabilityCheckInterval = section.Key("CheckInterval").MustDuration(AVAILABILITY_DEFAULT_CHECK_INTERVAL)
+
+	policy, err := ParseAutoUpdatePolicy(section)
+	if err != nil {
+		return fmt.Errorf("could not read auto-update policy, reason: %v", err)
+	}
+	us.AutoUpdate = policy
+
+	return nil
+}
+
+// StartAvailabilityCheckJob checks periodically if a newer version is
+// available for the server's channel
+func (us *UpdaterService) StartAvailabilityCheckJob() error {
+	var err error
+
+	us.AvailabilityCheckJob, err = us.TaskScheduler.NewJob(
+		gocron.DurationJob(us.AvailabilityCheckInterval),
+		gocron.NewTask(func() {
+			if _, err := us.CheckAvailableVersion(); err != nil {
+				log.Printf("[ERROR]: could not check the available version, reason: %v", err)
+			}
+		}),
+		// Give the updater time to connect with NATS before the first check
+		gocron.WithStartAt(gocron.WithStartDateTime(time.Now().Add(time.Minute))),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	)
+	if err != nil {
+		log.Printf("[ERROR]: could not start the availability check job, reason: %v", err)
+		return err
+	}
+	log.Printf("[INFO]: new availability check job has been scheduled every %s", us.AvailabilityCheckInterval)
+	return nil
+}
+
+// CheckAvailableVersion saves the newest version offered to the server,
+// publishes an event the first time a version newer than the installed one
+// is seen and applies the auto-update policy. It returns the newest version
+func (us *UpdaterService) CheckAvailableVersion() (string, error) {
+	if us.Model == nil {
+		return "", fmt.Errorf("the database is not connected")
+	}
+
+	channel := server.Channel(us.Channel)
+
+	var latest, source string
+	var publishedAt time.Time
+	var err error
+	if us.ManifestURL != "" {
+		source = AVAILABILITY_SOURCE_MANIFEST
+		latest, publishedAt, err = us.ManifestLatestVersion(channel)
+	} else {
+		source = AVAILABILITY_SOURCE_REPOSITORY
+		latest, err = us.RepositoryLatestVersion()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	hostname, err := models.GetHostname()
+	if err != nil {
+		return "", err
+	}
+
+	previous, err := us.Model.GetAvailableVersion(hostname)
+	if err != nil {
+		return "", err
+	}
+
+	if err := us.Model.SetAvailableVersion(channel, us.Version, latest, source); err != nil {
+		return "", err
+	}
+
+	detectedAt := time.Now()
+	if previous != nil && previous.LatestVersion == latest && !previous.DetectedAt.IsZero() {
+		detectedAt = previous.DetectedAt
+	}
+
+	if (previous == nil || previous.LatestVersion != latest || previous.Channel != channel) && isNewerVersion(latest, us.Version) {
+		message := fmt.Sprintf("%s is available in the %s channel, installed version is %s", latest, channel, us.Version)
+		log.Printf("[INFO]: %s", message)
+		us.PublishUpdateEvent(UpdatePhaseAvailable, latest, channel, message)
+	}
+
+	// The auto-update delay counts from the publication if the index has it
+	releasedAt := detectedAt
+	if !publishedAt.IsZero() {
+		releasedAt = publishedAt
+	}
+
+	us.ApplyAutoUpdatePolicy(latest, channel, releasedAt)
+	return latest, nil
+}
+
+// ManifestLatestVersion reads the newest version of the channel from the
+// release manifest and when it was published, the time is zero if the
+// manifest doesn't have it
+func (us *UpdaterService) ManifestLatestVersion(channel server.Channel) (string, time.Time, error) {
+	data, err := httpGet(us.ManifestURL)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("could not get release manifest, reason: %v", err)
+	}
+
+	index := ReleaseIndex{}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return "", time.Time{}, fmt.Errorf("could not unmarshal release manifest, reason: %v", err)
+	}
+
+	version := index.Channels[string(channel)]
+	if err := ValidateVersion(version); err != nil {
+		return "", time.Time{}, fmt.Errorf("release manifest has no valid version for the %s channel, reason: %v", channel, err)
+	}
+	return version, index.Published[version], nil
+}
+
+// isNewerVersion reports if the version is newer than the installed one,
+// versions that are not semantic versions are newer if they're different
+func isNewerVersion(version string, installed string) bool {
+	v, err := ParseSemVer(version)
+	if err != nil {
+		return version != installed
+	}
+
+	i, err := ParseSemVer(installed)
+	if err != nil {
+		return version != installed
+	}
+	return v.Compare(i) > 0
+}
+
+// httpGet returns the body of a small document like a release manifest
+func httpGet(url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
@@ -0,0 +1,221 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"gopkg.in/ini.v1"
+)
+
+const BACKUP_DEFAULT_RETENTION = 5
+
+type BackupRestoreRequest struct {
+	File string `json:"file"`
+}
+
+type BackupRestoreResponse struct {
+	File  string `json:"file,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// ReadBackupConfig reads the optional [Backup] section, backups are disabled
+// unless Enabled is set to yes
+func (us *UpdaterService) ReadBackupConfig(cfg *ini.File, defaultDirectory string) {
+	section := cfg.Section("Backup")
+
+	us.BackupEnabled = section.Key("Enabled").String() == "yes"
+	us.BackupDirectory = section.Key("Directory").MustString(defaultDirectory)
+	us.BackupRetention = section.Key("Retention").MustInt(BACKUP_DEFAULT_RETENTION)
+	if us.BackupRetention < 1 {
+		us.BackupRetention = BACKUP_DEFAULT_RETENTION
+	}
+}
+
+// BackupDatabase dumps the OpenUEM database with pg_dump using the same
+// connection settings the updater uses and removes the backups that exceed
+// the retention count
+func (us *UpdaterService) BackupDatabase(version string) (string, error) {
+	if err := os.MkdirAll(us.BackupDirectory, 0700); err != nil {
+		return "", fmt.Errorf("could not create backup directory, reason: %v", err)
+	}
+
+	backupPath := filepath.Join(us.BackupDirectory, fmt.Sprintf("openuem-%s-%s.dump", time.Now().Format("20060102150405"), us.Version))
+
+	cmd, err := us.postgresCommand("pg_dump", "--format=custom", "--file="+backupPath)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if err := os.Remove(backupPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("[ERROR]: could not remove incomplete backup %s, reason: %v", backupPath, err)
+		}
+		return "", fmt.Errorf("pg_dump failed, reason: %v %s", err, strings.TrimSpace(string(out)))
+	}
+	log.Printf("[INFO]: database has been backed up to %s before updating to %s", backupPath, version)
+
+	if err := us.pruneBackups(); err != nil {
+		log.Printf("[ERROR]: could not remove old backups, reason: %v", err)
+	}
+
+	return backupPath, nil
+}
+
+// RestoreDatabase restores a backup taken by BackupDatabase, the file must be
+// a backup stored in the backup directory
+func (us *UpdaterService) RestoreDatabase(file string) error {
+	backupPath := filepath.Join(us.BackupDirectory, filepath.Base(file))
+
+	if _, err := os.Stat(backupPath); err != nil {
+		return fmt.Errorf("could not find backup %s, reason: %v", backupPath, err)
+	}
+
+	cmd, err := us.postgresCommand("pg_restore", "--clean", "--if-exists", "--single-transaction", backupPath)
+	if err != nil {
+		return err
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("pg_restore failed, reason: %v %s", err, strings.TrimSpace(string(out)))
+	}
+	log.Printf("[INFO]: database has been restored from %s", backupPath)
+
+	return nil
+}
+
+// postgresCommand runs a PostgreSQL client against the OpenUEM database, the
+// password is passed in the environment as the arguments of a process can be
+// read by any local user
+func (us *UpdaterService) postgresCommand(name string, args ...string) (*exec.Cmd, error) {
+	dbURL, password, err := splitDatabasePassword(us.DBUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(name, append([]string{"--dbname=" + dbURL}, args...)...)
+	cmd.Env = os.Environ()
+	if password != "" {
+		cmd.Env = append(cmd.Env, "PGPASSWORD="+password)
+	}
+	return cmd, nil
+}
+
+// splitDatabasePassword returns the database url without the password and the password
+func splitDatabasePassword(dbURL string) (string, string, error) {
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		return "", "", errors.New("could not parse the database url")
+	}
+
+	if u.User == nil {
+		return dbURL, "", nil
+	}
+
+	password, ok := u.User.Password()
+	if !ok {
+		return dbURL, "", nil
+	}
+
+	u.User = url.User(u.User.Username())
+	return u.String(), password, nil
+}
+
+func (us *UpdaterService) pruneBackups() error {
+	backups, err := us.listBackups()
+	if err != nil {
+		return err
+	}
+
+	if len(backups) <= us.BackupRetention {
+		return nil
+	}
+
+	for _, b := range backups[:len(backups)-us.BackupRetention] {
+		if err := os.Remove(filepath.Join(us.BackupDirectory, b)); err != nil {
+			return err
+		}
+		log.Printf("[INFO]: old backup %s has been removed", b)
+	}
+
+	return nil
+}
+
+// listBackups returns the backups names sorted from oldest to newest
+func (us *UpdaterService) listBackups() ([]string, error) {
+	entries, err := os.ReadDir(us.BackupDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), "openuem-") && strings.HasSuffix(e.Name(), ".dump") {
+			backups = append(backups, e.Name())
+		}
+	}
+	slices.Sort(backups)
+
+	return backups, nil
+}
+
+// RestoreBackup restores the backup file or the most recent backup if no file
+// is given, and returns the name of the backup restored
+func (us *UpdaterService) RestoreBackup(file string) (string, error) {
+	if file == "" {
+		backups, err := us.listBackups()
+		if err != nil {
+			return "", fmt.Errorf("could not list backups, reason: %v", err)
+		}
+		if len(backups) == 0 {
+			return "", fmt.Errorf("no backups found in %s", us.BackupDirectory)
+		}
+		file = backups[len(backups)-1]
+	}
+
+	return file, us.RestoreDatabase(file)
+}
+
+// RestoreHandler restores a backup requested with NATS request/reply
+func (us *UpdaterService) RestoreHandler(msg *nats.Msg) {
+	request := BackupRestoreRequest{}
+	response := BackupRestoreResponse{}
+
+	if err := json.Unmarshal(msg.Data, &request); err != nil {
+		response.Error = fmt.Sprintf("could not unmarshal restore request, reason: %v", err)
+		us.respond(msg, response)
+		return
+	}
+
+	file, err := us.RestoreBackup(request.File)
+	if err != nil {
+		log.Printf("[ERROR]: %v", err)
+		response.Error = err.Error()
+	}
+	response.File = file
+
+	us.respond(msg, response)
+}
+
+func (us *UpdaterService) respond(msg *nats.Msg, response any) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("[ERROR]: could not marshal response, reason: %v", err)
+		return
+	}
+
+	if err := msg.Respond(data); err != nil {
+		log.Printf("[ERROR]: could not respond to %s, reason: %v", msg.Subject, err)
+	}
+}
@@ -0,0 +1,105 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/nats-io/nats.go"
+	"github.com/open-uem/ent/server"
+	"github.com/open-uem/utils"
+	"gopkg.in/ini.v1"
+)
+
+type ChannelSwitchRequest struct {
+	Channel string `json:"channel"`
+}
+
+type ChannelSwitchResponse struct {
+	Previous string `json:"previous,omitempty"`
+	Channel  string `json:"channel,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// SwitchChannel makes the server pull its updates from another channel. The
+// repository definition is switched first as it's the only step that can be
+// undone, it's restored if the config file can't be saved, and finally the
+// server row is moved
+func (us *UpdaterService) SwitchChannel(channel string) error {
+	to, err := ValidateChannel(channel)
+	if err != nil {
+		return err
+	}
+
+	from := server.Channel(us.Channel)
+	if from == to {
+		return nil
+	}
+
+	state, err := LoadUpdateState()
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		return errors.New("the channel can't be switched while an update is running")
+	}
+
+	if len(us.PendingUpdates()) > 0 {
+		return errors.New("the channel can't be switched while updates are pending, cancel them first")
+	}
+
+	restoreRepository, err := us.SwitchRepositoryChannel(from, to)
+	if err != nil {
+		return err
+	}
+
+	if err := saveChannelConfig(to); err != nil {
+		if err := restoreRepository(); err != nil {
+			log.Printf("[ERROR]: could not restore the %s repository, reason: %v", from, err)
+		}
+		return fmt.Errorf("could not save the channel in the config file, reason: %v", err)
+	}
+	us.Channel = string(to)
+	log.Printf("[INFO]: channel switched from %s to %s", from, to)
+
+	// The row is also moved when the updater starts if this fails
+	if us.Model != nil {
+		if err := us.Model.MoveServerChannel(to); err != nil {
+			return fmt.Errorf("could not move the server to the %s channel, reason: %v", to, err)
+		}
+	}
+	return nil
+}
+
+func saveChannelConfig(channel server.Channel) error {
+	configFile := utils.GetConfigFile()
+
+	cfg, err := ini.Load(configFile)
+	if err != nil {
+		return err
+	}
+
+	cfg.Section("Server").Key("Channel").SetValue(string(channel))
+	return cfg.SaveTo(configFile)
+}
+
+// ChannelSwitchHandler answers a switch channel request with the new channel
+func (us *UpdaterService) ChannelSwitchHandler(msg *nats.Msg) {
+	request := ChannelSwitchRequest{}
+	response := ChannelSwitchResponse{Previous: us.Channel}
+
+	if err := json.Unmarshal(msg.Data, &request); err != nil {
+		response.Error = fmt.Sprintf("could not unmarshal channel request, reason: %v", err)
+		us.respond(msg, response)
+		return
+	}
+
+	if err := us.SwitchChannel(request.Channel); err != nil {
+		log.Printf("[ERROR]: could not switch channel, reason: %v", err)
+		response.Error = err.Error()
+	}
+
+	response.Channel = us.Channel
+	us.respond(msg, response)
+}
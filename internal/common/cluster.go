@@ -0,0 +1,372 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/open-uem/ent/server"
+	"github.com/open-uem/openuem-server-updater/internal/models"
+	"gopkg.in/ini.v1"
+)
+
+// Rolling updates use a KV bucket whose keys are the update slots, the value
+// of a key is the hostname of the server updating. Keys expire with the
+// bucket's TTL so the slot of a server that died mid-update is released
+const (
+	UPDATE_LOCKS_BUCKET         = "SERVER_UPDATE_LOCKS"
+	CLUSTER_DEFAULT_SLOTS       = 1
+	CLUSTER_DEFAULT_LEASE_TTL   = 15 * time.Minute
+	CLUSTER_DEFAULT_RETRY_DELAY = 1 * time.Minute
+	CLUSTER_MIN_LEASE_TTL       = 1 * time.Minute
+)
+
+// ReadClusterConfig reads the optional [Cluster] section, rolling updates
+// are only coordinated if they're enabled. NATSMonitoringURL is the monitoring
+// endpoint of the local NATS node, it's used to check the quorum before
+// updating a clustered NATS node and the update is refused if it can't be read
+func (us *UpdaterService) ReadClusterConfig(cfg *ini.File) {
+	section := cfg.Section("Cluster")
+
+	us.ClusterEnabled = section.Key("RollingUpdates").MustBool(false)
+	us.ClusterSlots = section.Key("Slots").MustInt(CLUSTER_DEFAULT_SLOTS)
+	if us.ClusterSlots < 1 {
+		us.ClusterSlots = CLUSTER_DEFAULT_SLOTS
+	}
+	us.ClusterLeaseTTL = section.Key("LeaseTTL").MustDuration(CLUSTER_DEFAULT_LEASE_TTL)
+	if us.ClusterLeaseTTL < CLUSTER_MIN_LEASE_TTL {
+		us.ClusterLeaseTTL = CLUSTER_MIN_LEASE_TTL
+	}
+	us.ClusterRetryDelay = section.Key("RetryDelay").MustDuration(CLUSTER_DEFAULT_RETRY_DELAY)
+	us.NATSMonitoringURL = section.Key("NATSMonitoringURL").MustString(NATS_DEFAULT_MONITORING_URL)
+}
+
+// CreateUpdateLocks creates the KV bucket with the update slots and resumes
+// the lease this server held before the updater was restarted
+func (us *UpdaterService) CreateUpdateLocks(ctx context.Context, js jetstream.JetStream, replicas int) error {
+	if !us.ClusterEnabled {
+		return nil
+	}
+
+	config := jetstream.KeyValueConfig{
+		Bucket:  UPDATE_LOCKS_BUCKET,
+		TTL:     us.ClusterLeaseTTL,
+		History: 1,
+	}
+
+	if replicas > 1 {
+		config.Replicas = min(replicas, 5)
+	}
+
+	kv, err := js.CreateOrUpdateKeyValue(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	key, err := us.heldLeaseKey(kv)
+	if err != nil {
+		return err
+	}
+
+	us.leaseMutex.Lock()
+	us.updateLocks = kv
+	release := us.releaseLeaseOnConnect
+	us.releaseLeaseOnConnect = false
+	if !release {
+		us.leaseKey = key
+	}
+	us.leaseMutex.Unlock()
+
+	if key == "" {
+		return nil
+	}
+
+	if release {
+		us.releaseUpdateLease(key)
+		return nil
+	}
+
+	log.Printf("[INFO]: resuming the lease of update slot %s", key)
+	us.startLeaseRenewal(key)
+	return nil
+}
+
+// AcquireUpdateLease waits for a free update slot when rolling updates are
+// enabled. The update is retried later if every slot is taken, it returns
+// true if the update can go on
+func (us *UpdaterService) AcquireUpdateLease(data UpdateRequest, msg jetstream.Msg, channel server.Channel) bool {
+	if !us.ClusterEnabled {
+		return true
+	}
+
+	err := us.acquireUpdateLease()
+	if err == nil {
+		return true
+	}
+
+	message := fmt.Sprintf("waiting for a free update slot, update will be retried in %s: %v", us.ClusterRetryDelay, err)
+	log.Printf("[INFO]: %s", message)
+
+	if err := us.RetryUpdate(data, msg, channel, us.ClusterRetryDelay); err != nil {
+		log.Printf("[ERROR]: could not retry the update, reason: %v", err)
+	}
+
+	if us.Model != nil {
+		us.SetUpdateStatus(0, us.Version, channel, server.UpdateStatusPending, message, time.Now().Add(us.ClusterRetryDelay))
+	}
+	us.PublishUpdateEvent(UpdatePhaseScheduled, data.Version, channel, message)
+	return false
+}
+
+func (us *UpdaterService) acquireUpdateLease() error {
+	us.leaseMutex.Lock()
+	kv := us.updateLocks
+	held := us.leaseKey
+	us.leaseMutex.Unlock()
+
+	if kv == nil {
+		return errors.New("update slots are not available until NATS is connected")
+	}
+
+	// A failed update keeps its slot so the rollout stops until it's fixed,
+	// the slot is released with a request on server.updater.<hostname>.lease
+	if held != "" {
+		return nil
+	}
+
+	hostname, err := models.GetHostname()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	holders := []string{}
+	for i := range us.ClusterSlots {
+		key := fmt.Sprintf("slot-%d", i)
+
+		_, err := kv.Create(ctx, key, []byte(hostname))
+		if err == nil {
+			log.Printf("[INFO]: update slot %s has been acquired", key)
+			us.startLeaseRenewal(key)
+			return nil
+		}
+
+		if !errors.Is(err, jetstream.ErrKeyExists) {
+			return err
+		}
+
+		entry, err := kv.Get(ctx, key)
+		if err != nil {
+			if errors.Is(err, jetstream.ErrKeyNotFound) {
+				continue
+			}
+			return err
+		}
+
+		if string(entry.Value()) == hostname {
+			us.startLeaseRenewal(key)
+			return nil
+		}
+		holders = append(holders, string(entry.Value()))
+	}
+
+	return fmt.Errorf("updating servers: %s", strings.Join(holders, ", "))
+}
+
+// heldLeaseKey returns the slot held by this server, if any
+func (us *UpdaterService) heldLeaseKey(kv jetstream.KeyValue) (string, error) {
+	hostname, err := models.GetHostname()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for i := range us.ClusterSlots {
+		key := fmt.Sprintf("slot-%d", i)
+
+		entry, err := kv.Get(ctx, key)
+		if err != nil {
+			if errors.Is(err, jetstream.ErrKeyNotFound) {
+				continue
+			}
+			return "", err
+		}
+
+		if string(entry.Value()) == hostname {
+			return key, nil
+		}
+	}
+	return "", nil
+}
+
+// startLeaseRenewal keeps the slot while the updater is running, the lease
+// only expires if the updater stops for longer than the lease TTL
+func (us *UpdaterService) startLeaseRenewal(key string) {
+	us.leaseMutex.Lock()
+	defer us.leaseMutex.Unlock()
+
+	us.leaseKey = key
+	if us.leaseJob != nil {
+		return
+	}
+
+	// Renew often enough to survive a couple of failed renewals
+	job, err := us.TaskScheduler.NewJob(
+		gocron.DurationJob(us.ClusterLeaseTTL/3),
+		gocron.NewTask(us.renewUpdateLease),
+	)
+	if err != nil {
+		log.Printf("[ERROR]: could not start the lease renewal job, reason: %v", err)
+		return
+	}
+	us.leaseJob = job
+}
+
+func (us *UpdaterService) renewUpdateLease() {
+	us.leaseMutex.Lock()
+	kv := us.updateLocks
+	key := us.leaseKey
+	us.leaseMutex.Unlock()
+
+	if kv == nil || key == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	hostname, err := models.GetHostname()
+	if err != nil {
+		log.Printf("[ERROR]: could not renew the lease of update slot %s, reason: %v", key, err)
+		return
+	}
+
+	entry, err := kv.Get(ctx, key)
+	if err != nil {
+		log.Printf("[ERROR]: could not renew the lease of update slot %s, reason: %v", key, err)
+		return
+	}
+
+	if string(entry.Value()) != hostname {
+		log.Printf("[ERROR]: the lease of update slot %s expired and it's held by %s", key, string(entry.Value()))
+		return
+	}
+
+	if _, err := kv.Update(ctx, key, entry.Value(), entry.Revision()); err != nil {
+		log.Printf("[ERROR]: could not renew the lease of update slot %s, reason: %v", key, err)
+	}
+}
+
+// ReleaseUpdateLease frees the slot of this server once its update has been
+// verified, or aborted before installing anything, so the next server can
+// start updating. If NATS is not connected yet the slot is released when it connects
+func (us *UpdaterService) ReleaseUpdateLease() {
+	if !us.ClusterEnabled {
+		return
+	}
+
+	us.leaseMutex.Lock()
+	if us.updateLocks == nil {
+		us.releaseLeaseOnConnect = true
+		us.leaseMutex.Unlock()
+		return
+	}
+	key := us.leaseKey
+	us.leaseMutex.Unlock()
+
+	if key == "" {
+		return
+	}
+	us.releaseUpdateLease(key)
+}
+
+func (us *UpdaterService) releaseUpdateLease(key string) {
+	us.leaseMutex.Lock()
+	kv := us.updateLocks
+	if us.leaseJob != nil {
+		if err := us.TaskScheduler.RemoveJob(us.leaseJob.ID()); err != nil && !errors.Is(err, gocron.ErrJobNotFound) {
+			log.Printf("[ERROR]: could not stop the lease renewal job, reason: %v", err)
+		}
+		us.leaseJob = nil
+	}
+	us.leaseKey = ""
+	us.leaseMutex.Unlock()
+
+	hostname, err := models.GetHostname()
+	if err != nil {
+		log.Printf("[ERROR]: could not release update slot %s, reason: %v", key, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	entry, err := kv.Get(ctx, key)
+	if err != nil {
+		if !errors.Is(err, jetstream.ErrKeyNotFound) {
+			log.Printf("[ERROR]: could not release update slot %s, reason: %v", key, err)
+		}
+		return
+	}
+
+	// Only delete the slot if nobody took it after our lease expired
+	if string(entry.Value()) != hostname {
+		return
+	}
+
+	if err := kv.Delete(ctx, key, jetstream.LastRevision(entry.Revision())); err != nil {
+		log.Printf("[ERROR]: could not release update slot %s, reason: %v", key, err)
+		return
+	}
+	log.Printf("[INFO]: update slot %s has been released", key)
+}
+
+type LeaseReleaseResponse struct {
+	Released string `json:"released,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// LeaseReleaseHandler frees the update slot kept by a failed update once an
+// operator has checked this server, so the rolling update can go on
+func (us *UpdaterService) LeaseReleaseHandler(msg *nats.Msg) {
+	response := LeaseReleaseResponse{}
+
+	state, err := LoadUpdateState()
+	switch {
+	case !us.ClusterEnabled:
+		response.Error = "rolling updates are not enabled"
+	case err != nil:
+		response.Error = fmt.Sprintf("could not read update state, reason: %v", err)
+	case state != nil:
+		response.Error = "the update slot can't be released while an update is running"
+	}
+	if response.Error != "" {
+		us.respond(msg, response)
+		return
+	}
+
+	us.leaseMutex.Lock()
+	key := us.leaseKey
+	us.leaseMutex.Unlock()
+
+	if key == "" {
+		response.Error = "this server doesn't hold an update slot"
+		us.respond(msg, response)
+		return
+	}
+
+	log.Printf("[INFO]: release of update slot %s requested", key)
+	us.releaseUpdateLease(key)
+	response.Released = key
+	us.respond(msg, response)
+}
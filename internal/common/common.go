@@ -2,9 +2,14 @@ package common
 
 import (
 	"context"
+	"crypto/x509"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-co-op/gocron/v2"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 	"github.com/open-uem/openuem-server-updater/internal/models"
 	"github.com/open-uem/utils"
 )
@@ -33,4 +38,45 @@ type UpdaterService struct {
 	OCSPResponderInstalled      bool
 	Version                     string
 	Channel                     string
+	RepositoryFile              string
+	PackageManager              PackageManager
+	BackupEnabled               bool
+	BackupDirectory             string
+	BackupRetention             int
+	HealthEndpoints             map[string]string
+	HealthTimeout               time.Duration
+	HealthStepTimeout           time.Duration
+	ComponentVersions           map[string]string
+	MixedVersions               bool
+	PreflightMinFreeMB          uint64
+	PreflightRetryDelay         time.Duration
+	Maintenance                 *MaintenancePolicy
+	JetStream                   jetstream.JetStream
+	ClusterEnabled              bool
+	ClusterSlots                int
+	ClusterLeaseTTL             time.Duration
+	ClusterRetryDelay           time.Duration
+	NATSMonitoringURL           string
+	RequireSignedRequests       bool
+	SignatureMaxSkew            time.Duration
+	Signers                     []string
+	DownloadHosts               []string
+	MaxRequestAge               time.Duration
+	MaxScheduleAhead            time.Duration
+	ManifestURL                 string
+	AvailabilityCheckInterval   time.Duration
+	AvailabilityCheckJob        gocron.Job
+	AutoUpdate                  *AutoUpdatePolicy
+	eventsMutex                 sync.Mutex
+	pendingEvents               []UpdateEvent
+	pendingMutex                sync.Mutex
+	pendingUpdates              map[int64]*PendingUpdate
+	leaseMutex                  sync.Mutex
+	evaluatingUpdate            atomic.Bool
+	updateLocks                 jetstream.KeyValue
+	leaseKey                    string
+	leaseJob                    gocron.Job
+	releaseLeaseOnConnect       bool
+	signerRoots                 *x509.CertPool
+	nonces                      jetstream.KeyValue
 }
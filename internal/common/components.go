@@ -2,22 +2,19 @@ package common
 
 import (
 	"context"
-	"os"
-	"strings"
+	"log"
+	"slices"
 
 	"github.com/open-uem/ent/server"
+	"github.com/open-uem/openuem-server-updater/internal/models"
 )
 
 func (us *UpdaterService) SetInstalledComponents() error {
-	hostname, err := os.Hostname()
+	hostname, err := models.GetHostname()
 	if err != nil {
 		return err
 	}
 
-	// Fix #1 hostname must not contain dots and domain
-	hostnameParts := strings.Split(hostname, ".")
-	hostname = hostnameParts[0]
-
 	return us.Model.Client.Server.Update().
 		SetOcspComponent(us.OCSPResponderInstalled).
 		SetNatsComponent(us.NATSInstalled).
@@ -28,3 +25,74 @@ func (us *UpdaterService) SetInstalledComponents() error {
 		Where(server.Hostname(hostname)).
 		Exec(context.Background())
 }
+
+// ReadComponentVersions reads the version of every OpenUEM package installed,
+// if all of them agree that's the version reported for the server instead of
+// the version in the config file
+func (us *UpdaterService) ReadComponentVersions() {
+	versions, err := us.InstalledPackageVersions()
+	if err != nil {
+		log.Printf("[ERROR]: could not read installed package versions, reason: %v", err)
+		return
+	}
+	if len(versions) == 0 {
+		return
+	}
+
+	version := ""
+	mixed := false
+	for _, v := range versions {
+		if version == "" {
+			version = v
+		} else if v != version {
+			mixed = true
+		}
+	}
+
+	us.ComponentVersions = versions
+	us.MixedVersions = mixed
+
+	// A release manifest may install a different version of each package,
+	// the server is on the release version if they're the manifest's versions
+	if mixed {
+		if state, err := LoadUpdateState(); err == nil && state != nil && !state.RolledBack && us.installedStatePackages(state) {
+			version = state.Version
+			mixed = false
+			us.MixedVersions = false
+		}
+	}
+
+	if mixed {
+		log.Printf("[ERROR]: OpenUEM components are on mixed versions: %v", versions)
+		return
+	}
+
+	if version != us.Version {
+		log.Printf("[INFO]: config file reports version %s but installed packages are %s", us.Version, version)
+		us.Version = version
+	}
+}
+
+func (us *UpdaterService) SetComponentVersions() error {
+	if us.ComponentVersions == nil {
+		return nil
+	}
+	return us.Model.SetComponentVersions(us.ComponentVersions, us.MixedVersions)
+}
+
+// installedStatePackages reports if the packages updated by the package
+// manager have the versions of the update state
+func (us *UpdaterService) installedStatePackages(state *UpdateState) bool {
+	versions, err := us.InstalledUpdatePackages()
+	if err != nil || len(versions) == 0 {
+		return false
+	}
+
+	for name, version := range versions {
+		i := slices.IndexFunc(state.Packages, func(p Package) bool { return p.Name == name })
+		if i < 0 || !matchesVersion(version, state.Packages[i].Version) {
+			return false
+		}
+	}
+	return true
+}
@@ -5,7 +5,6 @@ import (
 	"time"
 
 	"github.com/go-co-op/gocron/v2"
-	"github.com/open-uem/ent/server"
 	"github.com/open-uem/openuem-server-updater/internal/models"
 )
 
@@ -16,31 +15,7 @@ func (us *UpdaterService) StartDBConnectJob() error {
 	if err == nil {
 		log.Println("[INFO]: connection established with database")
 
-		// Evaluate result of previous update
-		s, err := us.Model.GetServerStatus()
-		if err != nil {
-			log.Println("[ERROR]: could not get server status")
-		}
-
-		if s != nil && s.UpdateStatus == server.UpdateStatusInProgress {
-			if s.Version == us.Version {
-				if err := us.Model.UpdateServerStatus(s.Version, s.Channel, server.UpdateStatusSuccess, "", s.UpdateWhen); err != nil {
-					log.Printf("[ERROR]: could not save server status, reason: %v\n", err)
-				}
-			} else {
-				if err := us.Model.UpdateServerStatus(s.Version, s.Channel, server.UpdateStatusError, "installation didn't complete", s.UpdateWhen); err != nil {
-					log.Printf("[ERROR]: could not save server status, reason: %v\n", err)
-				}
-			}
-		}
-
-		if err := us.SetServer(); err != nil {
-			log.Fatalf("[FATAL]: %v", err)
-		}
-
-		if err := us.SetInstalledComponents(); err != nil {
-			log.Fatalf("[FATAL]: %v", err)
-		}
+		us.OnDBConnected()
 
 		return nil
 	}
@@ -63,31 +38,7 @@ func (us *UpdaterService) StartDBConnectJob() error {
 					return
 				}
 
-				// Evaluate result of previous update
-				s, err := us.Model.GetServerStatus()
-				if err != nil {
-					log.Println("[ERROR]: could not get server status")
-				}
-
-				if s.UpdateStatus == server.UpdateStatusInProgress {
-					if s.Version == us.Version {
-						if err := us.Model.UpdateServerStatus(s.Version, s.Channel, server.UpdateStatusSuccess, "", s.UpdateWhen); err != nil {
-							log.Printf("[ERROR]: could not save server status, reason: %v\n", err)
-						}
-					} else {
-						if err := us.Model.UpdateServerStatus(s.Version, s.Channel, server.UpdateStatusError, "installation didn't complete", s.UpdateWhen); err != nil {
-							log.Printf("[ERROR]: could not save server status, reason: %v\n", err)
-						}
-					}
-				}
-
-				if err := us.SetServer(); err != nil {
-					log.Fatalf("[FATAL]: %v", err)
-				}
-
-				if err := us.SetInstalledComponents(); err != nil {
-					log.Fatalf("[FATAL]: %v", err)
-				}
+				us.OnDBConnected()
 			},
 		),
 	)
@@ -98,3 +49,48 @@ func (us *UpdaterService) StartDBConnectJob() error {
 	log.Printf("[INFO]: new DB connect job has been scheduled every %d seconds", 30)
 	return nil
 }
+
+// OnDBConnected evaluates the previous update, registers this server and
+// restores the scheduled updates once the connection with the database has
+// been established. The evaluation may wait for the update runner and the
+// components for a long time, so it runs in a job and the updater goes on
+// connecting with NATS
+func (us *UpdaterService) OnDBConnected() {
+	us.evaluatingUpdate.Store(true)
+
+	_, err := us.TaskScheduler.NewJob(
+		gocron.OneTimeJob(
+			gocron.OneTimeJobStartImmediately(),
+		),
+		gocron.NewTask(us.evaluateAndRegister),
+	)
+	if err != nil {
+		log.Printf("[ERROR]: could not start the update evaluation job, reason: %v", err)
+		us.evaluateAndRegister()
+	}
+}
+
+func (us *UpdaterService) evaluateAndRegister() {
+	// Use the installed packages as the source of truth for versions
+	us.ReadComponentVersions()
+
+	// Evaluate result of previous update
+	us.EvaluatePreviousUpdate()
+
+	if err := us.SetServer(); err != nil {
+		log.Fatalf("[FATAL]: %v", err)
+	}
+
+	if err := us.SetInstalledComponents(); err != nil {
+		log.Fatalf("[FATAL]: %v", err)
+	}
+
+	if err := us.SetComponentVersions(); err != nil {
+		log.Printf("[ERROR]: could not save component versions, reason: %v", err)
+	}
+
+	us.evaluatingUpdate.Store(false)
+
+	// Schedule again the updates accepted before the updater was stopped
+	us.RestorePendingUpdates()
+}
@@ -0,0 +1,115 @@
+//go:build linux
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DnfPackageManager installs OpenUEM on Red Hat based distributions, every
+// component is shipped in its own package
+type DnfPackageManager struct{}
+
+func (pm *DnfPackageManager) Name() string {
+	return "dnf"
+}
+
+func (pm *DnfPackageManager) InstalledComponents() []string {
+	return installedOpenUEMPackages()
+}
+
+func (pm *DnfPackageManager) IsVersionAvailable(name string, version string) (bool, error) {
+	out, err := runQuery("dnf", "repoquery", "--refresh", "--queryformat", "%{version}\n", name)
+	if err != nil {
+		return false, err
+	}
+
+	for _, v := range strings.Split(out, "\n") {
+		if strings.TrimSpace(v) == version {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (pm *DnfPackageManager) Install(packages []Package, allowDowngrade bool, output io.Writer) error {
+	args := []string{"install", "--refresh", "-y"}
+	if allowDowngrade {
+		args = append(args, "--allow-downgrade")
+	}
+	for _, p := range packages {
+		args = append(args, fmt.Sprintf("%s-%s", p.Name, p.Version))
+	}
+	return runInstall(output, "dnf", args...)
+}
+
+func (pm *DnfPackageManager) Simulate(packages []Package) (*Transaction, error) {
+	args := []string{"install", "--assumeno", "--allow-downgrade", "--refresh"}
+	for _, p := range packages {
+		args = append(args, fmt.Sprintf("%s-%s", p.Name, p.Version))
+	}
+
+	out, err := runSimulation("dnf", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	t := Transaction{}
+	inTable := false
+	for _, line := range strings.Split(out, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "Installing:"), strings.HasPrefix(trimmed, "Upgrading:"), strings.HasPrefix(trimmed, "Downgrading:"), strings.HasPrefix(trimmed, "Installing dependencies:"):
+			inTable = true
+		case trimmed == "" || strings.HasPrefix(trimmed, "Transaction Summary"):
+			inTable = false
+		case strings.HasPrefix(trimmed, "Total download size:"):
+			t.DownloadSize = strings.TrimSpace(strings.TrimPrefix(trimmed, "Total download size:"))
+		case strings.HasPrefix(trimmed, "Error:"), strings.HasPrefix(trimmed, "Problem"), strings.HasPrefix(trimmed, "- "):
+			t.Conflicts = append(t.Conflicts, trimmed)
+		case inTable:
+			// Package Arch Version Repository Size
+			fields := strings.Fields(trimmed)
+			if len(fields) >= 3 {
+				t.Packages = append(t.Packages, PackageChange{Name: fields[0], To: fields[2]})
+			}
+		}
+	}
+	fillPreviousVersions(pm, &t)
+
+	return &t, nil
+}
+
+func (pm *DnfPackageManager) CheckLocks() error {
+	if err := pidFileLocked("/var/run/dnf.pid"); err != nil {
+		return err
+	}
+	return fcntlLocked("/var/lib/rpm/.rpm.lock")
+}
+
+func (pm *DnfPackageManager) InstalledVersion(name string) (string, error) {
+	return runQuery("rpm", "-q", "--queryformat", "%{VERSION}", name)
+}
+
+func (pm *DnfPackageManager) RepositoryFiles() []string {
+	return []string{"/etc/yum.repos.d/openuem.repo"}
+}
+
+func (pm *DnfPackageManager) Refresh(output io.Writer) error {
+	return runInstall(output, "dnf", "makecache", "--refresh")
+}
+
+func (pm *DnfPackageManager) LatestVersion(name string) (string, error) {
+	out, err := runQuery("dnf", "repoquery", "--latest-limit", "1", "--queryformat", "%{version}\n", name)
+	if err != nil {
+		return "", err
+	}
+
+	version := strings.TrimSpace(strings.Split(out, "\n")[0])
+	if version == "" {
+		return "", fmt.Errorf("the repository doesn't offer %s", name)
+	}
+	return version, nil
+}
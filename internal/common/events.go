@@ -0,0 +1,151 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/open-uem/ent/server"
+	"github.com/open-uem/openuem-server-updater/internal/models"
+)
+
+// Update lifecycle phases published as events
+const (
+	UpdatePhaseReceived       = "received"
+	UpdatePhaseScheduled      = "scheduled"
+	UpdatePhaseStarted        = "started"
+	UpdatePhasePackageManager = "package_manager"
+	UpdatePhaseVerification   = "verification"
+	UpdatePhaseFinished       = "finished"
+	UpdatePhaseFailed         = "failed"
+	UpdatePhaseRolledBack     = "rolled_back"
+	UpdatePhaseDryRun         = "dry_run"
+	UpdatePhaseCancelled      = "cancelled"
+	UpdatePhaseRejected       = "rejected"
+	UpdatePhaseAvailable      = "available"
+)
+
+// A rolled back update is saved with the error status, its message starts
+// with one of these prefixes so the console can tell it from a failed update
+const (
+	UPDATE_ROLLED_BACK_PREFIX     = "rolled back: "
+	UPDATE_ROLLBACK_FAILED_PREFIX = "rollback failed: "
+)
+
+// Events can't be published under server.update.> as those subjects belong to
+// SERVERS_STREAM, which uses an interest policy and would drop events with no
+// subscribers, so events have their own stream and late subscribers can catch up
+const (
+	EVENTS_STREAM  = "SERVER_EVENTS_STREAM"
+	EVENTS_SUBJECT = "server.events.update."
+	EVENTS_MAX_AGE = 7 * 24 * time.Hour
+	// EVENTS_MAX_PENDING is how many events are kept while NATS is not
+	// connected, the oldest events are dropped first
+	EVENTS_MAX_PENDING = 1000
+)
+
+type UpdateEvent struct {
+	Hostname  string    `json:"hostname"`
+	Phase     string    `json:"phase"`
+	Version   string    `json:"version"`
+	Channel   string    `json:"channel"`
+	Timestamp time.Time `json:"timestamp"`
+	Details   string    `json:"details,omitempty"`
+}
+
+func (us *UpdaterService) CreateEventsStream(ctx context.Context, js jetstream.JetStream, replicas int) error {
+	streamConfig := jetstream.StreamConfig{
+		Name:      EVENTS_STREAM,
+		Subjects:  []string{EVENTS_SUBJECT + ">"},
+		Retention: jetstream.LimitsPolicy,
+		MaxAge:    EVENTS_MAX_AGE,
+	}
+
+	if replicas > 1 {
+		streamConfig.Replicas = replicas
+	}
+
+	_, err := js.CreateOrUpdateStream(ctx, streamConfig)
+	return err
+}
+
+// PublishUpdateEvent publishes an update lifecycle event, events are kept in
+// memory until the updater is connected with NATS
+func (us *UpdaterService) PublishUpdateEvent(phase string, version string, channel server.Channel, details string) {
+	hostname, err := models.GetHostname()
+	if err != nil {
+		log.Printf("[ERROR]: could not get hostname, reason: %v", err)
+		return
+	}
+
+	event := UpdateEvent{
+		Hostname:  hostname,
+		Phase:     phase,
+		Version:   version,
+		Channel:   string(channel),
+		Timestamp: time.Now(),
+		Details:   details,
+	}
+
+	us.eventsMutex.Lock()
+	if len(us.pendingEvents) >= EVENTS_MAX_PENDING {
+		dropped := len(us.pendingEvents) - EVENTS_MAX_PENDING + 1
+		log.Printf("[ERROR]: %d update events couldn't be published and have been dropped", dropped)
+		us.pendingEvents = slices.Clone(us.pendingEvents[dropped:])
+	}
+	us.pendingEvents = append(us.pendingEvents, event)
+	us.eventsMutex.Unlock()
+
+	us.FlushUpdateEvents()
+}
+
+// SetJetStream sets the JetStream context once NATS is connected, it's
+// guarded by the events mutex as events may be published at the same time
+func (us *UpdaterService) SetJetStream(js jetstream.JetStream) {
+	us.eventsMutex.Lock()
+	defer us.eventsMutex.Unlock()
+
+	us.JetStream = js
+}
+
+// GetJetStream returns the JetStream context or nil if NATS is not connected yet
+func (us *UpdaterService) GetJetStream() jetstream.JetStream {
+	us.eventsMutex.Lock()
+	defer us.eventsMutex.Unlock()
+
+	return us.JetStream
+}
+
+// FlushUpdateEvents publishes the events that couldn't be published yet
+func (us *UpdaterService) FlushUpdateEvents() {
+	us.eventsMutex.Lock()
+	defer us.eventsMutex.Unlock()
+
+	if us.JetStream == nil {
+		return
+	}
+
+	for len(us.pendingEvents) > 0 {
+		event := us.pendingEvents[0]
+
+		data, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("[ERROR]: could not marshal update event, reason: %v", err)
+			us.pendingEvents = us.pendingEvents[1:]
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = us.JetStream.Publish(ctx, EVENTS_SUBJECT+event.Hostname, data)
+		cancel()
+		if err != nil {
+			log.Printf("[ERROR]: could not publish update event, reason: %v", err)
+			return
+		}
+
+		us.pendingEvents = us.pendingEvents[1:]
+	}
+}
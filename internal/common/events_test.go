@@ -0,0 +1,24 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/open-uem/ent/server"
+)
+
+func TestPendingEventsAreCapped(t *testing.T) {
+	us := &UpdaterService{}
+
+	for i := range EVENTS_MAX_PENDING + 10 {
+		us.PublishUpdateEvent(UpdatePhaseScheduled, "0.8.0", server.ChannelStable, string(rune('a'+i%26)))
+	}
+
+	if len(us.pendingEvents) != EVENTS_MAX_PENDING {
+		t.Fatalf("got %d pending events, want %d", len(us.pendingEvents), EVENTS_MAX_PENDING)
+	}
+
+	// The oldest events are dropped
+	if us.pendingEvents[0].Details != string(rune('a'+10)) {
+		t.Errorf("oldest pending event is %q, want %q", us.pendingEvents[0].Details, string(rune('a'+10)))
+	}
+}
@@ -0,0 +1,81 @@
+//go:build linux
+
+package common
+
+import (
+	"fmt"
+	"io"
+)
+
+// FakePackageManager is a scriptable package manager that lets ExecuteUpdate
+// run without touching the host. Set the fields to decide what the host looks
+// like, every install request is recorded in Installs and Downgrades
+type FakePackageManager struct {
+	Components      []string
+	Available       map[string][]string
+	Installed       map[string]string
+	InstallErr      error
+	Installs        [][]Package
+	Downgrades      []bool
+	Transaction     *Transaction
+	SimulateErr     error
+	LockErr         error
+	RepositoryPaths []string
+	RefreshErr      error
+}
+
+func (pm *FakePackageManager) Name() string {
+	return "fake"
+}
+
+func (pm *FakePackageManager) InstalledComponents() []string {
+	return pm.Components
+}
+
+func (pm *FakePackageManager) IsVersionAvailable(name string, version string) (bool, error) {
+	for _, v := range pm.Available[name] {
+		if v == version {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (pm *FakePackageManager) Install(packages []Package, allowDowngrade bool, output io.Writer) error {
+	pm.Installs = append(pm.Installs, packages)
+	pm.Downgrades = append(pm.Downgrades, allowDowngrade)
+	return pm.InstallErr
+}
+
+func (pm *FakePackageManager) Simulate(packages []Package) (*Transaction, error) {
+	return pm.Transaction, pm.SimulateErr
+}
+
+func (pm *FakePackageManager) CheckLocks() error {
+	return pm.LockErr
+}
+
+func (pm *FakePackageManager) InstalledVersion(name string) (string, error) {
+	version, ok := pm.Installed[name]
+	if !ok {
+		return "", fmt.Errorf("%s is not installed", name)
+	}
+	return version, nil
+}
+
+// LatestVersion returns the last version listed as available for the package
+func (pm *FakePackageManager) LatestVersion(name string) (string, error) {
+	versions := pm.Available[name]
+	if len(versions) == 0 {
+		return "", fmt.Errorf("the repository doesn't offer %s", name)
+	}
+	return versions[len(versions)-1], nil
+}
+
+func (pm *FakePackageManager) RepositoryFiles() []string {
+	return pm.RepositoryPaths
+}
+
+func (pm *FakePackageManager) Refresh(output io.Writer) error {
+	return pm.RefreshErr
+}
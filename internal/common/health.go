@@ -0,0 +1,173 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+const (
+	HEALTH_DEFAULT_TIMEOUT      = 2 * time.Minute
+	HEALTH_DEFAULT_STEP_TIMEOUT = 5 * time.Minute
+)
+
+// Component describes an OpenUEM server component that can be flagged in the
+// [Components] section of the config file
+type Component struct {
+	Name     string
+	Package  string
+	Service  string
+	Endpoint string
+}
+
+// ComponentCheck is the result of verifying a component after an update
+type ComponentCheck struct {
+	Component string
+	Errors    []string
+}
+
+func (c ComponentCheck) Passed() bool {
+	return len(c.Errors) == 0
+}
+
+func (c ComponentCheck) String() string {
+	if c.Passed() {
+		return c.Component + ": ok"
+	}
+	return c.Component + ": " + strings.Join(c.Errors, ", ")
+}
+
+var versionRegexp = regexp.MustCompile(`\d+\.\d+\.\d+[0-9A-Za-z.+-]*`)
+
+var openUEMComponents = []Component{
+	{Name: "NATS", Package: "openuem-nats-service", Service: "openuem-nats-service", Endpoint: "localhost:4433"},
+	{Name: "OCSP", Package: "openuem-ocsp-responder", Service: "openuem-ocsp-responder", Endpoint: "localhost:8000"},
+	{Name: "AgentWorker", Package: "openuem-agent-worker", Service: "openuem-agent-worker"},
+	{Name: "CertManagerWorker", Package: "openuem-cert-manager-worker", Service: "openuem-cert-manager-worker"},
+	{Name: "NotificationWorker", Package: "openuem-notification-worker", Service: "openuem-notification-worker"},
+	{Name: "Console", Package: "openuem-console", Service: "openuem-console", Endpoint: "localhost:1323"},
+}
+
+// ReadHealthConfig reads the optional [Health] section where the endpoint of
+// a component can be set with the <Component>Endpoint key and StepTimeout
+// limits how long each start step of an update waits for its components
+func (us *UpdaterService) ReadHealthConfig(cfg *ini.File) {
+	section := cfg.Section("Health")
+
+	us.HealthEndpoints = map[string]string{}
+	for _, c := range openUEMComponents {
+		us.HealthEndpoints[c.Name] = section.Key(c.Name + "Endpoint").MustString(c.Endpoint)
+	}
+	us.HealthTimeout = section.Key("Timeout").MustDuration(HEALTH_DEFAULT_TIMEOUT)
+	us.HealthStepTimeout = section.Key("StepTimeout").MustDuration(HEALTH_DEFAULT_STEP_TIMEOUT)
+}
+
+// InstalledOpenUEMComponents returns the components flagged as installed in the config file
+func (us *UpdaterService) InstalledOpenUEMComponents() []Component {
+	installed := map[string]bool{
+		"NATS":               us.NATSInstalled,
+		"OCSP":               us.OCSPResponderInstalled,
+		"AgentWorker":        us.AgentWorkerInstalled,
+		"CertManagerWorker":  us.CertManagerWorkerInstalled,
+		"NotificationWorker": us.NotificationWorkerInstalled,
+		"Console":            us.ConsoleInstalled,
+	}
+
+	components := []Component{}
+	for _, c := range openUEMComponents {
+		if installed[c.Name] {
+			components = append(components, c)
+		}
+	}
+	return components
+}
+
+// VerifyComponents checks that every installed component is running the
+// expected version and answers, checks are repeated until they pass or the
+// health timeout expires as services may still be starting. It's run by the
+// evaluation job so the updater doesn't wait for it to start. The version of a
+// package installed by the update, that may come from a release manifest,
+// is expected instead of the version if it's different
+func (us *UpdaterService) VerifyComponents(version string, packages []Package) ([]ComponentCheck, bool) {
+	deadline := time.Now().Add(us.HealthTimeout)
+
+	for {
+		checks := []ComponentCheck{}
+		passed := true
+		for _, c := range us.InstalledOpenUEMComponents() {
+			expected := version
+			for _, p := range packages {
+				if p.Name == c.Package {
+					expected = p.Version
+				}
+			}
+
+			check := us.VerifyComponent(c, expected)
+			if !check.Passed() {
+				passed = false
+			}
+			checks = append(checks, check)
+		}
+
+		if passed || time.Now().After(deadline) {
+			return checks, passed
+		}
+
+		log.Printf("[INFO]: components are not healthy yet: %s", SummarizeChecks(checks))
+		time.Sleep(10 * time.Second)
+	}
+}
+
+func (us *UpdaterService) VerifyComponent(c Component, version string) ComponentCheck {
+	check := ComponentCheck{Component: c.Name}
+
+	if err := ServiceActive(c.Service); err != nil {
+		check.Errors = append(check.Errors, fmt.Sprintf("service is not active (%v)", err))
+	}
+
+	installed, err := us.ComponentVersion(c)
+	if err != nil {
+		check.Errors = append(check.Errors, fmt.Sprintf("could not get version (%v)", err))
+	} else if installed != version {
+		check.Errors = append(check.Errors, fmt.Sprintf("version is %s instead of %s", installed, version))
+	}
+
+	if err := checkEndpoint(us.HealthEndpoints[c.Name]); err != nil {
+		check.Errors = append(check.Errors, err.Error())
+	}
+
+	return check
+}
+
+// checkEndpoint checks that the component accepts connections, components
+// without endpoint always pass
+func checkEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", endpoint, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("endpoint %s doesn't answer", endpoint)
+	}
+	conn.Close()
+	return nil
+}
+
+func SummarizeChecks(checks []ComponentCheck) string {
+	summary := []string{}
+	for _, c := range checks {
+		summary = append(summary, c.String())
+	}
+	return strings.Join(summary, "; ")
+}
+
+// parseVersion returns the first version found in a --version output
+func parseVersion(output string) string {
+	return versionRegexp.FindString(output)
+}
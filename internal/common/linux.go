@@ -3,19 +3,21 @@
 package common
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-co-op/gocron/v2"
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/open-uem/ent/server"
-	openuem_nats "github.com/open-uem/nats"
 	"github.com/open-uem/utils"
-	"github.com/zcalusic/sysinfo"
 	"gopkg.in/ini.v1"
 )
 
@@ -65,6 +67,9 @@ func (us *UpdaterService) ReadConfig() error {
 	}
 	us.Channel = key.String()
 
+	// The OpenUEM repository definition can be set if it's not in the default path
+	us.RepositoryFile = cfg.Section("Server").Key("RepositoryFile").String()
+
 	key, err = cfg.Section("Components").GetKey("OCSP")
 	if err == nil {
 		if key.String() == "yes" {
@@ -114,6 +119,22 @@ func (us *UpdaterService) ReadConfig() error {
 		return err
 	}
 
+	us.ReadBackupConfig(cfg, "/var/lib/openuem-server/backups")
+	us.ReadHealthConfig(cfg)
+	us.ReadPreflightConfig(cfg)
+	us.ReadClusterConfig(cfg)
+	us.ReadValidationConfig(cfg)
+
+	if err := us.ReadMaintenanceConfig(cfg); err != nil {
+		log.Printf("[ERROR]: %v", err)
+		return err
+	}
+
+	if err := us.ReadUpdatesConfig(cfg); err != nil {
+		log.Printf("[ERROR]: %v", err)
+		return err
+	}
+
 	// Read required certificates and private key
 	key, err = cfg.Section("Certificates").GetKey("UpdaterCert")
 	if err != nil {
@@ -151,98 +172,379 @@ func (us *UpdaterService) ReadConfig() error {
 		log.Fatalf("[FATAL]: could not read CA certificate")
 	}
 
+	if err := us.ReadSecurityConfig(cfg); err != nil {
+		log.Printf("[ERROR]: %v", err)
+		return err
+	}
+
 	return nil
 }
 
-func (us *UpdaterService) ExecuteUpdate(data openuem_nats.OpenUEMUpdateRequest, msg jetstream.Msg, version string, channel server.Channel) {
-	var cmd *exec.Cmd
-	var err error
-
-	operatingSystem := GetOSVendor()
-
-	if err := msg.Ack(); err != nil {
-		log.Printf("[ERROR]: could not ACK message, reason: %v", err)
+func (us *UpdaterService) ExecuteUpdate(data UpdateRequest, msg jetstream.Msg, version string, channel server.Channel) {
+	// Retried and restored updates may start outside the maintenance windows
+	if !us.CheckMaintenanceWindow(data, msg, channel) {
 		return
 	}
 
-	if err := us.Model.UpdateServerStatus(data.Version, channel, server.UpdateStatusInProgress, "", time.Now()); err != nil {
-		log.Printf("[ERROR]: could not save server status, reason: %v", err)
+	if !us.RunPreflight(data, msg, channel) {
+		return
 	}
 
-	switch operatingSystem {
-	case "debian", "ubuntu", "linuxmint":
-		cmd = exec.Command("/bin/sh", "-c", fmt.Sprintf("echo \"%s\" | at -M now +1 minute", "sudo apt update -y && sudo apt install -y --allow-downgrades openuem-server="+data.Version))
-		err := cmd.Start()
-		if err != nil {
-			log.Printf("[ERROR]: could not run %s command, reason: %v", cmd.String(), err)
+	// The message is acknowledged before the update slot is taken and the
+	// leaderships are moved, so a failed ACK leaves nothing to undo. From now
+	// on the update is retried as a scheduled update. Scheduled updates were
+	// acknowledged once stored
+	if msg != nil {
+		if err := msg.Ack(); err != nil {
+			log.Printf("[ERROR]: could not ACK message, reason: %v", err)
+			historyID := us.StartUpdateHistory(data, channel)
+			us.SetUpdateStatus(historyID, data.Version, channel, server.UpdateStatusError, fmt.Sprintf("could not ACK the update request, reason: %v", err), time.Now())
 			return
 		}
-		log.Println("[INFO]: update command has been started: ", cmd.String())
+		msg = nil
+	}
+
+	// Rolling updates wait for a free update slot
+	if !us.AcquireUpdateLease(data, msg, channel) {
+		return
+	}
+
+	// A clustered NATS node can only be restarted if JetStream keeps its
+	// quorum, the leaderships are moved once this server holds the slot
+	if !us.PrepareNATSUpdate(data, msg, channel) {
+		return
+	}
+
+	historyID := us.StartUpdateHistory(data, channel)
+	us.SetUpdateStatus(historyID, data.Version, channel, server.UpdateStatusInProgress, "", time.Now())
+	us.PublishUpdateEvent(UpdatePhaseStarted, data.Version, channel, "")
+
+	// Nothing has been installed if the update is aborted before the runner
+	// starts, so the update slot is released for the next server
+	pm, err := us.GetPackageManager()
+	if err != nil {
+		log.Printf("[ERROR]: %v", err)
+		us.ReleaseUpdateLease()
+		us.SetUpdateStatus(historyID, data.Version, channel, server.UpdateStatusError, err.Error(), time.Now())
+		return
+	}
 
-		if err := cmd.Wait(); err != nil {
-			log.Printf("[ERROR]: Command finished with error: %v", err)
+	if us.BackupEnabled {
+		if _, err := us.BackupDatabase(version); err != nil {
+			log.Printf("[ERROR]: update aborted, could not back up the database, reason: %v", err)
+			us.ReleaseUpdateLease()
+			us.SetUpdateStatus(historyID, data.Version, channel, server.UpdateStatusError, fmt.Sprintf("update aborted, could not back up the database, reason: %v", err), time.Now())
 			return
 		}
-		log.Println("[INFO]: update command has been programmed: ", cmd.String())
-	case "fedora", "almalinux", "redhat", "rocky":
-		packages := []string{}
+	}
 
-		_, err = os.Stat("/opt/openuem-server/bin/openuem-nats-service")
-		if err == nil {
-			packages = append(packages, "openuem-nats-service-"+version)
-		}
-		_, err = os.Stat("/opt/openuem-server/bin/openuem-ocsp-responder")
-		if err == nil {
-			packages = append(packages, "openuem-ocsp-responder-"+version)
+	plan, err := us.ReleasePlan(data)
+	if err != nil {
+		log.Printf("[ERROR]: update aborted, %v", err)
+		us.ReleaseUpdateLease()
+		us.SetUpdateStatus(historyID, data.Version, channel, server.UpdateStatusError, "update aborted, "+err.Error(), time.Now())
+		return
+	}
+
+	packages := []Package{}
+	state := UpdateState{HistoryID: historyID, Version: version, Channel: channel, StartedAt: time.Now(), PreviousVersion: us.Version, LogFile: UpdateLogFile(historyID, "")}
+	if plan != nil {
+		packages = plan.Packages
+		state.MigrationLevels = plan.MigrationLevels
+	} else {
+		for _, name := range pm.InstalledComponents() {
+			packages = append(packages, Package{Name: name, Version: version})
 		}
-		_, err = os.Stat("/opt/openuem-server/bin/openuem-agent-worker")
-		if err == nil {
-			packages = append(packages, "openuem-agent-worker-"+version)
+	}
+
+	// Pacman can't install the previous versions so there's nothing to roll back to
+	if _, ok := pm.(*PacmanPackageManager); ok {
+		log.Printf("[INFO]: the update won't be rolled back if it fails as %s can't downgrade packages", pm.Name())
+	} else {
+		for _, p := range packages {
+			previous, err := pm.InstalledVersion(p.Name)
+			if err != nil {
+				log.Printf("[ERROR]: %s won't be rolled back if the update fails, reason: %v", p.Name, err)
+				continue
+			}
+			state.PreviousPackages = append(state.PreviousPackages, Package{Name: p.Name, Version: previous})
 		}
-		_, err = os.Stat("/opt/openuem-server/bin/openuem-cert-manager-worker")
-		if err == nil {
-			packages = append(packages, "openuem-cert-manager-worker-"+version)
+	}
+
+	state.Packages = packages
+	state.PackageManager = pm.Name()
+	state.AllowDowngrade = data.AllowDowngrade
+
+	// The runner stops and starts the components in order as it doesn't read the config
+	for _, c := range us.InstalledOpenUEMComponents() {
+		state.Components = append(state.Components, c.Name)
+	}
+	state.HealthEndpoints = us.HealthEndpoints
+	state.StepTimeout = us.HealthStepTimeout
+
+	us.PublishUpdateEvent(UpdatePhasePackageManager, data.Version, channel, pm.Name()+" is installing the update")
+	if err := StartUpdateRunner(&state); err != nil {
+		log.Printf("[ERROR]: %v", err)
+		RemoveUpdateState()
+		us.ReleaseUpdateLease()
+		us.SetUpdateStatus(historyID, data.Version, channel, server.UpdateStatusError, err.Error(), time.Now())
+		return
+	}
+}
+
+// DryRun asks the package manager what it would change to install the
+// update without installing anything
+func (us *UpdaterService) DryRun(data UpdateRequest) *DryRunReport {
+	report := DryRunReport{Version: data.Version, Channel: data.Channel}
+
+	pm, err := us.GetPackageManager()
+	if err != nil {
+		report.Error = err.Error()
+		return &report
+	}
+	report.PackageManager = pm.Name()
+
+	packages, err := us.RequestedPackages(pm, data)
+	if err != nil {
+		report.Error = err.Error()
+		return &report
+	}
+
+	t, err := pm.Simulate(packages)
+	if err != nil {
+		report.Error = err.Error()
+		return &report
+	}
+	if t == nil {
+		t = &Transaction{}
+	}
+	report.Transaction = t
+
+	return &report
+}
+
+// PlatformPreflightChecks checks disk space, the repository, the package
+// database locks and the tools needed to run the update
+func (us *UpdaterService) PlatformPreflightChecks(data UpdateRequest) []PreflightFailure {
+	failures := []PreflightFailure{}
+
+	for _, path := range []string{"/opt", "/var", "/tmp"} {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(path, &stat); err != nil {
+			failures = append(failures, PreflightFailure{Check: "disk space", Reason: fmt.Sprintf("could not check %s, reason: %v", path, err)})
+			continue
 		}
-		_, err = os.Stat("/opt/openuem-server/bin/openuem-notification-worker")
-		if err == nil {
-			packages = append(packages, "openuem-notification-worker-"+version)
+		free := stat.Bavail * uint64(stat.Bsize) / 1024 / 1024
+		if free < us.PreflightMinFreeMB {
+			failures = append(failures, PreflightFailure{Check: "disk space", Reason: fmt.Sprintf("%s has %d MB free, %d MB required", path, free, us.PreflightMinFreeMB), Transient: true})
 		}
-		_, err = os.Stat("/opt/openuem-server/bin/openuem-console")
-		if err == nil {
-			packages = append(packages, "openuem-console-"+version)
+	}
+
+	for _, tool := range []string{"systemd-run", "systemctl"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			failures = append(failures, PreflightFailure{Check: "runner", Reason: tool + " is not available"})
 		}
-		_, err = os.Stat("/opt/openuem-server/bin/openuem-server-updater")
-		if err == nil {
-			packages = append(packages, "openuem-server-updater-"+version)
+	}
+
+	pm, err := us.GetPackageManager()
+	if err != nil {
+		return append(failures, PreflightFailure{Check: "package manager", Reason: err.Error()})
+	}
+
+	if err := pm.CheckLocks(); err != nil {
+		failures = append(failures, PreflightFailure{Check: "package database", Reason: err.Error(), Transient: true})
+	}
+
+	if _, ok := pm.(*PacmanPackageManager); ok && data.AllowDowngrade {
+		failures = append(failures, PreflightFailure{Check: "package manager", Reason: "allow_downgrade is not supported with pacman, it can only install the versions offered by the repository"})
+	}
+
+	packages, err := us.RequestedPackages(pm, data)
+	if err != nil {
+		return append(failures, PreflightFailure{Check: "release manifest", Reason: err.Error()})
+	}
+
+	for _, p := range packages {
+		available, err := pm.IsVersionAvailable(p.Name, p.Version)
+		if err != nil {
+			failures = append(failures, PreflightFailure{Check: "repository", Reason: err.Error(), Transient: true})
+			break
 		}
-		_, err = os.Stat("/usr/bin/openuem-cert-manager")
-		if err == nil {
-			packages = append(packages, "openuem-cert-manager-"+version)
+		if !available {
+			failures = append(failures, PreflightFailure{Check: "repository", Reason: fmt.Sprintf("%s %s is not available", p.Name, p.Version)})
 		}
+	}
+
+	return failures
+}
+
+// RequestedPackages returns the packages the update installs, every package
+// gets the requested version unless the release manifest sets its version
+func (us *UpdaterService) RequestedPackages(pm PackageManager, data UpdateRequest) ([]Package, error) {
+	plan, err := us.ReleasePlan(data)
+	if err != nil {
+		return nil, err
+	}
+	if plan != nil {
+		return plan.Packages, nil
+	}
 
-		cmd = exec.Command("/bin/sh", "-c", fmt.Sprintf("echo \"sudo dnf install --allow-downgrade --refresh -y %s\" | at -M now +1 minute", strings.Join(packages, " ")))
-		err := cmd.Start()
+	packages := []Package{}
+	for _, name := range pm.InstalledComponents() {
+		packages = append(packages, Package{Name: name, Version: data.Version})
+	}
+	return packages, nil
+}
+
+// InstalledUpdatePackages returns the version of the packages the package
+// manager updates, on Debian that's only the openuem-server meta package
+func (us *UpdaterService) InstalledUpdatePackages() (map[string]string, error) {
+	pm, err := us.GetPackageManager()
+	if err != nil {
+		return nil, err
+	}
+
+	versions := map[string]string{}
+	for _, name := range pm.InstalledComponents() {
+		version, err := pm.InstalledVersion(name)
 		if err != nil {
-			log.Printf("[ERROR]: could not run %s command, reason: %v", cmd.String(), err)
-			return
+			return nil, fmt.Errorf("could not get %s version, reason: %v", name, err)
 		}
-		log.Println("[INFO]: update command has been started: ", cmd.String())
+		versions[name] = version
+	}
+	return versions, nil
+}
 
-		if err := cmd.Wait(); err != nil {
-			log.Printf("[ERROR]: Command finished with error: %v", err)
-			return
+// ManifestFamily returns the key of the release manifest packages for this
+// host, that's the distro family
+func ManifestFamily() (string, error) {
+	return GetOSFamily()
+}
+
+// GetPackageManager returns the package manager for this host's distro family
+func (us *UpdaterService) GetPackageManager() (PackageManager, error) {
+	if us.PackageManager != nil {
+		return us.PackageManager, nil
+	}
+
+	family, err := GetOSFamily()
+	if err != nil {
+		return nil, fmt.Errorf("could not detect the distro family, reason: %v", err)
+	}
+
+	pm, err := NewPackageManager(family)
+	if err != nil {
+		return nil, fmt.Errorf("could not find a package manager, reason: %v", err)
+	}
+	us.PackageManager = pm
+
+	return pm, nil
+}
+
+// Rollback reinstalls the versions that were installed before the update
+func (us *UpdaterService) Rollback(state *UpdateState, reason string) error {
+	prepareRollback(state, reason)
+	return StartUpdateRunner(state)
+}
+
+// prepareRollback turns the state of a failed update into the state that
+// reinstalls the previous packages
+func prepareRollback(state *UpdateState, reason string) {
+	state.RolledBack = true
+	state.Reason = reason
+	state.Packages = state.PreviousPackages
+	state.AllowDowngrade = true
+	state.LogFile = UpdateLogFile(state.HistoryID, "-rollback")
+}
+
+func UpdateStateFile() string {
+	return "/var/lib/openuem-server-updater/update-state.json"
+}
+
+func UpdateLogDirectory() string {
+	return "/var/log/openuem-server/updates"
+}
+
+// ServiceActive returns an error with the unit state if the unit is not active
+func ServiceActive(service string) error {
+	out, err := exec.Command("systemctl", "is-active", service).Output()
+	if err != nil {
+		return fmt.Errorf("%s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// COMPONENT_VERSION_TIMEOUT is how long we wait for a binary to report its version
+const COMPONENT_VERSION_TIMEOUT = 10 * time.Second
+
+// ComponentVersion returns the version reported by the component's binary or
+// the version in the package database if the binary can't report it, a binary
+// that hangs is killed after COMPONENT_VERSION_TIMEOUT
+func (us *UpdaterService) ComponentVersion(c Component) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), COMPONENT_VERSION_TIMEOUT)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, filepath.Join("/opt/openuem-server/bin", c.Package), "--version").Output()
+	if err == nil {
+		if version := parseVersion(string(out)); version != "" {
+			return version, nil
 		}
-		log.Println("[INFO]: update command has been programmed: ", cmd.String())
-	default:
-		return
 	}
 
+	pm, err := us.GetPackageManager()
+	if err != nil {
+		return "", err
+	}
+	return pm.InstalledVersion(c.Package)
 }
 
-func GetOSVendor() string {
-	var si sysinfo.SysInfo
+// InstalledPackageVersions returns the version in the package database of
+// every OpenUEM package installed
+func (us *UpdaterService) InstalledPackageVersions() (map[string]string, error) {
+	pm, err := us.GetPackageManager()
+	if err != nil {
+		return nil, err
+	}
 
-	si.GetSysInfo()
+	versions := map[string]string{}
+	for _, name := range installedOpenUEMPackages() {
+		version, err := pm.InstalledVersion(name)
+		if err != nil {
+			log.Printf("[ERROR]: could not get %s version, reason: %v", name, err)
+			continue
+		}
+		versions[name] = version
+	}
+	return versions, nil
+}
+
+// RepositoryLatestVersion asks the package manager for the newest version of
+// the OpenUEM packages in the repository of the server's channel
+func (us *UpdaterService) RepositoryLatestVersion() (string, error) {
+	state, err := LoadUpdateState()
+	if err != nil {
+		return "", err
+	}
+	if state != nil {
+		return "", errors.New("an update is running")
+	}
 
-	return si.OS.Vendor
+	pm, err := us.GetPackageManager()
+	if err != nil {
+		return "", err
+	}
+
+	components := pm.InstalledComponents()
+	if len(components) == 0 {
+		return "", errors.New("no OpenUEM packages are installed")
+	}
+
+	if err := pm.CheckLocks(); err != nil {
+		return "", err
+	}
+
+	if err := pm.Refresh(io.Discard); err != nil {
+		return "", err
+	}
+	return pm.LatestVersion(components[0])
 }
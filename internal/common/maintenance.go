@@ -0,0 +1,261 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/open-uem/ent/server"
+	"gopkg.in/ini.v1"
+)
+
+// MAINTENANCE_SEARCH_DAYS is how far we look for the next allowed slot
+const MAINTENANCE_SEARCH_DAYS = 400
+
+// MaintenanceWindow is a weekly time range where updates are allowed, if
+// the end is before the start the window ends the next day
+type MaintenanceWindow struct {
+	Weekday     time.Weekday
+	StartHour   int
+	StartMinute int
+	EndHour     int
+	EndMinute   int
+}
+
+// FreezePeriod is a date range, both days included, where updates are not allowed
+type FreezePeriod struct {
+	From time.Time
+	To   time.Time
+}
+
+type MaintenancePolicy struct {
+	Windows  []MaintenanceWindow
+	Freezes  []FreezePeriod
+	Location *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// ReadMaintenanceConfig reads the optional [Maintenance] section, e.g.
+//
+//	Windows = Sat 22:00-06:00, Sun 00:00-23:59
+//	Freeze = 2026-12-20/2027-01-07
+//	TimeZone = Europe/Madrid
+func (us *UpdaterService) ReadMaintenanceConfig(cfg *ini.File) error {
+	section := cfg.Section("Maintenance")
+
+	policy, err := ParseMaintenancePolicy(section.Key("Windows").String(), section.Key("Freeze").String(), section.Key("TimeZone").String())
+	if err != nil {
+		return fmt.Errorf("could not read maintenance windows, reason: %v", err)
+	}
+	us.Maintenance = policy
+
+	return nil
+}
+
+func ParseMaintenancePolicy(windows string, freezes string, timezone string) (*MaintenancePolicy, error) {
+	policy := MaintenancePolicy{Location: time.Local}
+
+	if timezone != "" {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, err
+		}
+		policy.Location = location
+	}
+
+	for _, w := range splitList(windows) {
+		day, hours, found := strings.Cut(w, " ")
+		if !found {
+			return nil, fmt.Errorf("window %q must be like Sat 22:00-06:00", w)
+		}
+
+		days := []time.Weekday{}
+		if strings.EqualFold(day, "daily") {
+			for d := time.Sunday; d <= time.Saturday; d++ {
+				days = append(days, d)
+			}
+		} else {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("unknown weekday %q", day)
+			}
+			days = append(days, weekday)
+		}
+
+		start, end, found := strings.Cut(strings.TrimSpace(hours), "-")
+		if !found {
+			return nil, fmt.Errorf("window %q must be like Sat 22:00-06:00", w)
+		}
+		startTime, err := time.Parse("15:04", strings.TrimSpace(start))
+		if err != nil {
+			return nil, err
+		}
+		endTime, err := time.Parse("15:04", strings.TrimSpace(end))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, d := range days {
+			policy.Windows = append(policy.Windows, MaintenanceWindow{
+				Weekday:     d,
+				StartHour:   startTime.Hour(),
+				StartMinute: startTime.Minute(),
+				EndHour:     endTime.Hour(),
+				EndMinute:   endTime.Minute(),
+			})
+		}
+	}
+
+	for _, f := range splitList(freezes) {
+		from, to, found := strings.Cut(f, "/")
+		if !found {
+			to = from
+		}
+		fromDate, err := time.ParseInLocation("2006-01-02", strings.TrimSpace(from), policy.Location)
+		if err != nil {
+			return nil, err
+		}
+		toDate, err := time.ParseInLocation("2006-01-02", strings.TrimSpace(to), policy.Location)
+		if err != nil {
+			return nil, err
+		}
+		if toDate.Before(fromDate) {
+			return nil, fmt.Errorf("freeze period %q ends before it starts", f)
+		}
+		policy.Freezes = append(policy.Freezes, FreezePeriod{From: fromDate, To: toDate.AddDate(0, 0, 1)})
+	}
+
+	return &policy, nil
+}
+
+// Allowed reports if an update can run at that time
+func (p *MaintenancePolicy) Allowed(t time.Time) bool {
+	t = t.In(p.Location)
+
+	for _, f := range p.Freezes {
+		if !t.Before(f.From) && t.Before(f.To) {
+			return false
+		}
+	}
+
+	if len(p.Windows) == 0 {
+		return true
+	}
+
+	// A window that started yesterday may still be open
+	for _, day := range []time.Time{t, t.AddDate(0, 0, -1)} {
+		for _, w := range p.Windows {
+			if day.Weekday() != w.Weekday {
+				continue
+			}
+			start, end := w.On(day)
+			if !t.Before(start) && t.Before(end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// On returns when the window opens and closes on that day
+func (w MaintenanceWindow) On(day time.Time) (time.Time, time.Time) {
+	start := time.Date(day.Year(), day.Month(), day.Day(), w.StartHour, w.StartMinute, 0, 0, day.Location())
+	end := time.Date(day.Year(), day.Month(), day.Day(), w.EndHour, w.EndMinute, 0, 0, day.Location())
+	if !end.After(start) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return start, end
+}
+
+// NextSlot returns the first time not before t when an update is allowed
+func (p *MaintenancePolicy) NextSlot(t time.Time) (time.Time, error) {
+	if p.Allowed(t) {
+		return t, nil
+	}
+
+	// A slot starts when a window opens or when a freeze ends
+	candidates := []time.Time{}
+	local := t.In(p.Location)
+	for d := 0; d < MAINTENANCE_SEARCH_DAYS; d++ {
+		day := local.AddDate(0, 0, d)
+		for _, w := range p.Windows {
+			if day.Weekday() == w.Weekday {
+				start, _ := w.On(day)
+				candidates = append(candidates, start)
+			}
+		}
+	}
+	for _, f := range p.Freezes {
+		candidates = append(candidates, f.To)
+	}
+	slices.SortFunc(candidates, func(a, b time.Time) int { return a.Compare(b) })
+
+	for _, c := range candidates {
+		if c.After(t) && p.Allowed(c) {
+			return c, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("no maintenance window available in the next %d days", MAINTENANCE_SEARCH_DAYS)
+}
+
+// CheckMaintenanceWindow defers the update to the next maintenance window if
+// it would start outside the windows, a retried or restored update may start
+// later than the time it was accepted for. It returns true if the update can go on
+func (us *UpdaterService) CheckMaintenanceWindow(data UpdateRequest, msg jetstream.Msg, channel server.Channel) bool {
+	if us.Maintenance == nil || us.Maintenance.Allowed(time.Now()) {
+		return true
+	}
+
+	slot, err := us.Maintenance.NextSlot(time.Now())
+	if err != nil {
+		log.Printf("[ERROR]: update rejected, %v", err)
+		if msg != nil {
+			if err := msg.Term(); err != nil {
+				log.Printf("[ERROR]: could not terminate message, reason: %v", err)
+			}
+		}
+		if us.Model != nil {
+			historyID := us.StartUpdateHistory(data, channel)
+			us.SetUpdateStatus(historyID, data.Version, channel, server.UpdateStatusError, "update rejected, "+err.Error(), time.Now())
+		} else {
+			us.PublishUpdateEvent(UpdatePhaseFailed, data.Version, channel, "update rejected, "+err.Error())
+		}
+		return false
+	}
+
+	message := "update deferred to the next maintenance window at " + slot.Format(time.RFC3339)
+	log.Printf("[INFO]: %s", message)
+
+	if err := us.RetryUpdate(data, msg, channel, time.Until(slot)); err != nil {
+		log.Printf("[ERROR]: could not retry the update, reason: %v", err)
+	}
+
+	if us.Model != nil {
+		us.SetUpdateStatus(0, us.Version, channel, server.UpdateStatusPending, message, slot)
+	}
+	us.PublishUpdateEvent(UpdatePhaseScheduled, data.Version, channel, message)
+	return false
+}
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
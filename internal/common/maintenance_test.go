@@ -0,0 +1,101 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenancePolicyAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		windows string
+		freezes string
+		at      time.Time
+		want    bool
+	}{
+		{name: "inside a window that crosses midnight", windows: "Sat 22:00-06:00", at: utc(2026, 3, 7, 23, 0), want: true},
+		{name: "before the window opens", windows: "Sat 22:00-06:00", at: utc(2026, 3, 7, 21, 59), want: false},
+		{name: "next weekday before the window closes", windows: "Sat 22:00-06:00", at: utc(2026, 3, 8, 5, 59), want: true},
+		{name: "next weekday when the window closes", windows: "Sat 22:00-06:00", at: utc(2026, 3, 8, 6, 0), want: false},
+		{name: "no windows", at: utc(2026, 3, 9, 12, 0), want: true},
+		{name: "inside a freeze", windows: "Daily 00:00-23:59", freezes: "2026-12-24/2027-01-07", at: utc(2027, 1, 7, 12, 0), want: false},
+		{name: "after a freeze", windows: "Daily 00:00-23:59", freezes: "2026-12-24/2027-01-07", at: utc(2027, 1, 8, 12, 0), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParseMaintenancePolicy(tt.windows, tt.freezes, "UTC")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.Allowed(tt.at); got != tt.want {
+				t.Errorf("Allowed(%s) = %v, want %v", tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaintenancePolicyNextSlot(t *testing.T) {
+	tests := []struct {
+		name    string
+		windows string
+		freezes string
+		at      time.Time
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name:    "inside a window that crosses midnight",
+			windows: "Sat 22:00-06:00",
+			at:      utc(2026, 3, 8, 1, 0),
+			want:    utc(2026, 3, 8, 1, 0),
+		},
+		{
+			name:    "after the window closed on the next weekday",
+			windows: "Sat 22:00-06:00",
+			at:      utc(2026, 3, 8, 7, 0),
+			want:    utc(2026, 3, 14, 22, 0),
+		},
+		{
+			name:    "first window after a freeze",
+			windows: "Daily 01:00-03:00",
+			freezes: "2026-12-24/2027-01-07",
+			at:      utc(2026, 12, 24, 2, 0),
+			want:    utc(2027, 1, 8, 1, 0),
+		},
+		{
+			name:    "end of a freeze without windows",
+			freezes: "2026-12-24/2027-01-07",
+			at:      utc(2026, 12, 25, 10, 0),
+			want:    utc(2027, 1, 8, 0, 0),
+		},
+		{
+			name:    "no open slot",
+			windows: "Wed 10:00-11:00",
+			freezes: "2026-01-01/2028-01-01",
+			at:      utc(2026, 3, 9, 12, 0),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParseMaintenancePolicy(tt.windows, tt.freezes, "UTC")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := p.NextSlot(tt.at)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NextSlot() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !got.Equal(tt.want) {
+				t.Errorf("NextSlot(%s) = %s, want %s", tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func utc(year int, month time.Month, day int, hour int, minute int) time.Time {
+	return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+}
@@ -0,0 +1,355 @@
+package common
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Package names are passed to the package managers as arguments
+var packageNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9+._-]{0,127}$`)
+
+// SignedManifest is a release manifest signed with a certificate issued by
+// the CA, the signature covers the manifest exactly as it was sent
+type SignedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"`
+	Signer    string          `json:"signer"`
+}
+
+// ReleaseManifest describes what a release installs, components may have
+// a version different from the release version
+type ReleaseManifest struct {
+	Version    string              `json:"version"`
+	Channel    string              `json:"channel,omitempty"`
+	Components []ManifestComponent `json:"components"`
+}
+
+// ManifestComponent is a component of the release. Packages maps a distro
+// family, or windows, with the package name of the component. The component
+// can only be installed over MinUpgradeFrom or newer and MigrationLevel is the
+// database migration level it requires
+type ManifestComponent struct {
+	Name           string             `json:"name"`
+	Version        string             `json:"version"`
+	Packages       map[string]string  `json:"packages"`
+	Artifacts      []ManifestArtifact `json:"artifacts,omitempty"`
+	MinUpgradeFrom string             `json:"min_upgrade_from,omitempty"`
+	MigrationLevel int                `json:"migration_level,omitempty"`
+}
+
+type ManifestArtifact struct {
+	OS     string `json:"os"`
+	Arch   string `json:"arch"`
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// ManifestPlan is what a release manifest installs in this server
+type ManifestPlan struct {
+	Packages        []Package
+	MigrationLevels map[string]int
+	DownloadFrom    string
+	DownloadHash    string
+}
+
+// Component returns the component that ships the package in the distro family
+func (m *ReleaseManifest) Component(family string, name string) *ManifestComponent {
+	for i, c := range m.Components {
+		if c.Packages[family] == name {
+			return &m.Components[i]
+		}
+	}
+	return nil
+}
+
+// ResolveReleaseManifest fetches the release manifest of the request if it
+// only has its url, verifies it and fills the version, channel and download
+// fields of the request with the manifest. The manifest is kept in the
+// request so a scheduled update installs the manifest that was accepted
+func (us *UpdaterService) ResolveReleaseManifest(data *UpdateRequest) error {
+	if data.Manifest == nil && data.ManifestURL == "" {
+		return nil
+	}
+
+	if data.Manifest == nil {
+		if err := us.ValidateDownloadURL(data.ManifestURL); err != nil {
+			return fmt.Errorf("release manifest url is not valid, reason: %v", err)
+		}
+
+		body, err := httpGet(data.ManifestURL)
+		if err != nil {
+			return fmt.Errorf("could not get release manifest, reason: %v", err)
+		}
+
+		signed := SignedManifest{}
+		if err := json.Unmarshal(body, &signed); err != nil {
+			return fmt.Errorf("could not unmarshal release manifest, reason: %v", err)
+		}
+		data.Manifest = &signed
+	}
+	data.ManifestURL = ""
+
+	m, err := us.VerifyReleaseManifest(data.Manifest)
+	if err != nil {
+		return err
+	}
+
+	if data.Version != "" && data.Version != m.Version {
+		return fmt.Errorf("requested version %s doesn't match the release manifest version %s", data.Version, m.Version)
+	}
+	data.Version = m.Version
+
+	if m.Channel != "" {
+		if data.Channel != "" && data.Channel != m.Channel {
+			return fmt.Errorf("requested channel %s doesn't match the release manifest channel %s", data.Channel, m.Channel)
+		}
+		data.Channel = m.Channel
+	}
+
+	plan, err := us.PlanReleaseManifest(m, *data)
+	if err != nil {
+		return err
+	}
+
+	if plan.DownloadFrom != "" {
+		if data.DownloadFrom != "" && (data.DownloadFrom != plan.DownloadFrom || !strings.EqualFold(data.DownloadHash, plan.DownloadHash)) {
+			return errors.New("requested download doesn't match the release manifest installer")
+		}
+		data.DownloadFrom = plan.DownloadFrom
+		data.DownloadHash = plan.DownloadHash
+	}
+	return nil
+}
+
+// VerifyReleaseManifest checks the signature of the manifest and returns it
+func (us *UpdaterService) VerifyReleaseManifest(signed *SignedManifest) (*ReleaseManifest, error) {
+	signer, err := us.verifySigner(signed.Signer)
+	if err != nil {
+		return nil, fmt.Errorf("release manifest rejected, reason: %v", err)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode release manifest signature, reason: %v", err)
+	}
+
+	if err := verifySignature(signer, signed.Manifest, signature); err != nil {
+		return nil, fmt.Errorf("release manifest rejected, reason: %v", err)
+	}
+
+	m := ReleaseManifest{}
+	if err := json.Unmarshal(signed.Manifest, &m); err != nil {
+		return nil, fmt.Errorf("could not unmarshal release manifest, reason: %v", err)
+	}
+	return &m, nil
+}
+
+// ReleasePlan returns what the release manifest of an accepted request
+// installs or nil if the request has no manifest. The manifest is verified
+// and checked again as scheduled requests are read from the database, and the
+// database or the packages may have changed since it was accepted
+func (us *UpdaterService) ReleasePlan(data UpdateRequest) (*ManifestPlan, error) {
+	if data.Manifest == nil {
+		return nil, nil
+	}
+
+	m, err := us.VerifyReleaseManifest(data.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return us.PlanReleaseManifest(m, data)
+}
+
+// PlanReleaseManifest validates the manifest against the installed packages
+// and returns the version of each package. Every installed package must be in
+// the manifest, be new enough to be upgraded and its version must pass the
+// version policy with the overrides of the request
+func (us *UpdaterService) PlanReleaseManifest(m *ReleaseManifest, data UpdateRequest) (*ManifestPlan, error) {
+	if err := us.ValidateReleaseManifest(m); err != nil {
+		return nil, err
+	}
+
+	channel, err := ValidateChannel(data.Channel)
+	if err != nil {
+		return nil, err
+	}
+
+	family, err := ManifestFamily()
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := us.InstalledUpdatePackages()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range versions {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	plan := ManifestPlan{MigrationLevels: map[string]int{}}
+	var installer *ManifestArtifact
+	for _, name := range names {
+		c := m.Component(family, name)
+		if c == nil {
+			return nil, fmt.Errorf("release manifest doesn't include the installed package %s for %s", name, family)
+		}
+
+		if err := checkMinUpgradeFrom(c, name, versions[name]); err != nil {
+			return nil, err
+		}
+
+		// The package database may add a release suffix to the version
+		installed := versions[name]
+		if matchesVersion(installed, c.Version) {
+			installed = c.Version
+		}
+
+		if _, err := checkVersionPolicy(c.Version, installed, data, channel); err != nil {
+			return nil, fmt.Errorf("version policy refused %s: %v", name, err)
+		}
+
+		plan.Packages = append(plan.Packages, Package{Name: name, Version: c.Version})
+		if c.MigrationLevel > 0 {
+			plan.MigrationLevels[c.Name] = c.MigrationLevel
+		}
+
+		for i, a := range c.Artifacts {
+			if a.OS != runtime.GOOS || a.Arch != runtime.GOARCH {
+				continue
+			}
+			if installer != nil && (installer.URL != a.URL || !strings.EqualFold(installer.SHA256, a.SHA256)) {
+				return nil, fmt.Errorf("release manifest has more than one installer for %s/%s", runtime.GOOS, runtime.GOARCH)
+			}
+			installer = &c.Artifacts[i]
+		}
+	}
+
+	// The Windows installer installs every component
+	if runtime.GOOS == "windows" {
+		if installer == nil {
+			return nil, fmt.Errorf("release manifest has no installer for %s/%s", runtime.GOOS, runtime.GOARCH)
+		}
+		plan.DownloadFrom = installer.URL
+		plan.DownloadHash = installer.SHA256
+	}
+
+	return &plan, nil
+}
+
+// ValidateReleaseManifest checks every field of the manifest and refuses
+// components whose migration level is lower than the level of the database
+func (us *UpdaterService) ValidateReleaseManifest(m *ReleaseManifest) error {
+	if err := ValidateVersion(m.Version); err != nil {
+		return fmt.Errorf("release manifest: %v", err)
+	}
+
+	if m.Channel != "" {
+		if _, err := ValidateChannel(m.Channel); err != nil {
+			return fmt.Errorf("release manifest: %v", err)
+		}
+	}
+
+	if len(m.Components) == 0 {
+		return errors.New("release manifest has no components")
+	}
+
+	levels := map[string]int{}
+	if us.Model != nil {
+		var err error
+		levels, err = us.Model.GetMigrationLevels()
+		if err != nil {
+			return fmt.Errorf("could not get database migration levels, reason: %v", err)
+		}
+	}
+
+	names := []string{}
+	for _, c := range m.Components {
+		if c.Name == "" || slices.Contains(names, c.Name) {
+			return fmt.Errorf("release manifest component %q is empty or repeated", c.Name)
+		}
+		names = append(names, c.Name)
+
+		if err := ValidateVersion(c.Version); err != nil {
+			return fmt.Errorf("release manifest component %s: %v", c.Name, err)
+		}
+
+		if c.MinUpgradeFrom != "" {
+			if err := ValidateVersion(c.MinUpgradeFrom); err != nil {
+				return fmt.Errorf("release manifest component %s minimum version: %v", c.Name, err)
+			}
+		}
+
+		for family, name := range c.Packages {
+			if !packageNameRegexp.MatchString(name) {
+				return fmt.Errorf("release manifest component %s has an invalid package name for %s", c.Name, family)
+			}
+			if err := ValidatePackageName(name); err != nil {
+				return fmt.Errorf("release manifest component %s: %v", c.Name, err)
+			}
+		}
+
+		for _, a := range c.Artifacts {
+			if a.OS == "" || a.Arch == "" {
+				return fmt.Errorf("release manifest component %s has an artifact without os or arch", c.Name)
+			}
+			if err := us.ValidateDownload(a.URL, a.SHA256); err != nil {
+				return fmt.Errorf("release manifest component %s: %v", c.Name, err)
+			}
+		}
+
+		if c.MigrationLevel < 0 {
+			return fmt.Errorf("release manifest component %s has a negative migration level", c.Name)
+		}
+
+		// Older binaries can't use a database migrated by a newer release
+		if level, ok := levels[c.Name]; ok && c.MigrationLevel < level {
+			return fmt.Errorf("release manifest component %s requires migration level %d but the database is at level %d", c.Name, c.MigrationLevel, level)
+		}
+	}
+	return nil
+}
+
+// checkMinUpgradeFrom refuses to upgrade a package older than the minimum
+// version the component can be upgraded from
+func checkMinUpgradeFrom(c *ManifestComponent, name string, installed string) error {
+	if c.MinUpgradeFrom == "" || matchesVersion(installed, c.MinUpgradeFrom) {
+		return nil
+	}
+
+	minimum, err := ParseSemVer(c.MinUpgradeFrom)
+	if err != nil {
+		return err
+	}
+
+	i, err := ParseSemVer(installed)
+	if err != nil {
+		return fmt.Errorf("installed version %q of %s is unknown, it must be %s or newer", installed, name, c.MinUpgradeFrom)
+	}
+
+	if i.Compare(minimum) < 0 {
+		return fmt.Errorf("%s %s can't be upgraded to %s, upgrade to %s first", name, installed, c.Version, c.MinUpgradeFrom)
+	}
+	return nil
+}
+
+// SaveMigrationLevels records the database migration levels reached by a
+// successful update
+func (us *UpdaterService) SaveMigrationLevels(state *UpdateState) {
+	for component, level := range state.MigrationLevels {
+		if err := us.Model.SetMigrationLevel(component, level, state.Version); err != nil {
+			log.Printf("[ERROR]: could not save migration level of %s, reason: %v", component, err)
+		}
+	}
+}
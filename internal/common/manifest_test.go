@@ -0,0 +1,103 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckMinUpgradeFrom(t *testing.T) {
+	tests := []struct {
+		name           string
+		minUpgradeFrom string
+		installed      string
+		wantErr        bool
+	}{
+		{name: "no minimum", installed: "0.5.0"},
+		{name: "newer than the minimum", minUpgradeFrom: "0.7.0", installed: "0.7.3"},
+		{name: "the minimum", minUpgradeFrom: "0.7.0", installed: "0.7.0"},
+		{name: "the minimum with a release suffix", minUpgradeFrom: "0.7.0", installed: "0.7.0-1"},
+		{name: "older than the minimum", minUpgradeFrom: "0.7.0", installed: "0.6.9", wantErr: true},
+		{name: "unknown installed version", minUpgradeFrom: "0.7.0", installed: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ManifestComponent{Name: "console", Version: "0.8.0", MinUpgradeFrom: tt.minUpgradeFrom}
+			err := checkMinUpgradeFrom(c, "openuem-console", tt.installed)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkMinUpgradeFrom() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateReleaseManifest(t *testing.T) {
+	hash := strings.Repeat("a", 64)
+
+	valid := func() *ReleaseManifest {
+		return &ReleaseManifest{
+			Version: "0.8.0",
+			Channel: "stable",
+			Components: []ManifestComponent{
+				{
+					Name:     "console",
+					Version:  "0.8.0",
+					Packages: map[string]string{"debian": "openuem-server", "redhat": "openuem-console"},
+					Artifacts: []ManifestArtifact{
+						{OS: "windows", Arch: "amd64", URL: "https://releases.openuem.eu/openuem-server-0.8.0.exe", SHA256: hash},
+					},
+					MinUpgradeFrom: "0.7.0",
+					MigrationLevel: 3,
+				},
+				{
+					Name:     "agent-worker",
+					Version:  "0.8.1",
+					Packages: map[string]string{"redhat": "openuem-agent-worker"},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(m *ReleaseManifest)
+		wantErr string
+	}{
+		{name: "valid manifest", modify: func(m *ReleaseManifest) {}},
+		{name: "invalid version", modify: func(m *ReleaseManifest) { m.Version = "next" }, wantErr: "release manifest:"},
+		{name: "invalid channel", modify: func(m *ReleaseManifest) { m.Channel = "nightly" }, wantErr: "release manifest:"},
+		{name: "no components", modify: func(m *ReleaseManifest) { m.Components = nil }, wantErr: "no components"},
+		{name: "repeated component", modify: func(m *ReleaseManifest) { m.Components[1].Name = "console" }, wantErr: "empty or repeated"},
+		{name: "unnamed component", modify: func(m *ReleaseManifest) { m.Components[1].Name = "" }, wantErr: "empty or repeated"},
+		{name: "invalid component version", modify: func(m *ReleaseManifest) { m.Components[1].Version = "" }, wantErr: "component agent-worker"},
+		{name: "invalid minimum version", modify: func(m *ReleaseManifest) { m.Components[0].MinUpgradeFrom = "0.7" }, wantErr: "minimum version"},
+		{name: "invalid package name", modify: func(m *ReleaseManifest) { m.Components[1].Packages["redhat"] = "openuem; rm -rf /" }, wantErr: "invalid package name"},
+		{name: "artifact without arch", modify: func(m *ReleaseManifest) { m.Components[0].Artifacts[0].Arch = "" }, wantErr: "without os or arch"},
+		{name: "artifact from another host", modify: func(m *ReleaseManifest) {
+			m.Components[0].Artifacts[0].URL = "https://example.com/openuem-server-0.8.0.exe"
+		}, wantErr: "not allowed"},
+		{name: "artifact without hash", modify: func(m *ReleaseManifest) { m.Components[0].Artifacts[0].SHA256 = "" }, wantErr: "SHA-256"},
+		{name: "negative migration level", modify: func(m *ReleaseManifest) { m.Components[1].MigrationLevel = -1 }, wantErr: "negative migration level"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Without a database the migration levels are not checked
+			us := &UpdaterService{DownloadHosts: []string{"releases.openuem.eu"}}
+
+			m := valid()
+			tt.modify(m)
+
+			err := us.ValidateReleaseManifest(m)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ValidateReleaseManifest() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateReleaseManifest() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+//go:build linux
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The console and the workers are stopped before the packages are installed
+// so they don't run against a half upgraded server. Once installed the
+// components are started in dependency order: NATS and OCSP first, then the
+// workers that need them and the console last
+var (
+	stopSteps = [][]string{
+		{"Console"},
+		{"AgentWorker", "CertManagerWorker", "NotificationWorker"},
+	}
+	startSteps = [][]string{
+		{"NATS", "OCSP"},
+		{"AgentWorker", "CertManagerWorker", "NotificationWorker"},
+		{"Console"},
+	}
+)
+
+// The runner controls the services through these functions so the update
+// flow can run without systemd in tests
+var (
+	systemctl = func(args ...string) ([]byte, error) {
+		return exec.Command("systemctl", args...).CombinedOutput()
+	}
+	serviceActive = ServiceActive
+)
+
+// runOrderedUpdate stops the components, installs the packages and starts
+// the components step by step, each step waits until its components are
+// healthy. Every step is started even if the installation or a previous step
+// fails so the server is not left stopped, the errors are returned together
+func runOrderedUpdate(state *UpdateState, pm PackageManager, output io.Writer) error {
+	for _, step := range stopSteps {
+		for _, c := range stepComponents(state, step) {
+			fmt.Fprintf(output, "==> stopping %s\n", c.Service)
+			if out, err := systemctl("stop", c.Service); err != nil {
+				fmt.Fprintf(output, "could not stop %s, reason: %v %s\n", c.Service, err, strings.TrimSpace(string(out)))
+			}
+		}
+	}
+
+	fmt.Fprintf(output, "==> installing %d packages with %s\n", len(state.Packages), pm.Name())
+	errs := []error{}
+	if err := pm.Install(state.Packages, state.AllowDowngrade, output); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, step := range startSteps {
+		components := stepComponents(state, step)
+		if len(components) == 0 {
+			continue
+		}
+
+		// Restart as the package scripts may have started the old binaries
+		// or started the components out of order
+		for _, c := range components {
+			fmt.Fprintf(output, "==> starting %s\n", c.Service)
+			if out, err := systemctl("restart", c.Service); err != nil {
+				fmt.Fprintf(output, "could not start %s, reason: %v %s\n", c.Service, err, strings.TrimSpace(string(out)))
+			}
+		}
+
+		if err := waitForComponents(state, components, output); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// stepComponents returns the installed components of a step
+func stepComponents(state *UpdateState, step []string) []Component {
+	components := []Component{}
+	for _, c := range openUEMComponents {
+		for _, name := range step {
+			if c.Name == name && slices.Contains(state.Components, name) {
+				components = append(components, c)
+			}
+		}
+	}
+	return components
+}
+
+// waitForComponents waits until the services are active and their endpoints
+// answer or the step timeout expires
+func waitForComponents(state *UpdateState, components []Component, output io.Writer) error {
+	timeout := state.StepTimeout
+	if timeout == 0 {
+		timeout = HEALTH_DEFAULT_STEP_TIMEOUT
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		failures := []string{}
+		for _, c := range components {
+			if err := serviceActive(c.Service); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: service is not active (%v)", c.Name, err))
+				continue
+			}
+			if err := checkEndpoint(state.HealthEndpoints[c.Name]); err != nil {
+				failures = append(failures, c.Name+": "+err.Error())
+			}
+		}
+
+		if len(failures) == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			err := errors.New("components are not healthy after " + timeout.String() + ": " + strings.Join(failures, "; "))
+			fmt.Fprintf(output, "%v\n", err)
+			return err
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+}
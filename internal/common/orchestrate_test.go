@@ -0,0 +1,153 @@
+//go:build linux
+
+package common
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunOrderedUpdate(t *testing.T) {
+	previous := []Package{{Name: "openuem-console", Version: "0.7.0"}}
+	requested := []Package{{Name: "openuem-console", Version: "0.8.0"}}
+
+	tests := []struct {
+		name          string
+		installErr    error
+		rollback      bool
+		wantErr       bool
+		wantPackages  []Package
+		wantDowngrade bool
+	}{
+		{
+			name:         "successful install",
+			wantPackages: requested,
+		},
+		{
+			name:         "install failure",
+			installErr:   errors.New("dependency problems"),
+			wantErr:      true,
+			wantPackages: requested,
+		},
+		{
+			name:          "rollback",
+			rollback:      true,
+			wantPackages:  previous,
+			wantDowngrade: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm := &FakePackageManager{InstallErr: tt.installErr}
+
+			// No components are installed so no service is stopped or started
+			state := &UpdateState{
+				HistoryID:        1,
+				Version:          "0.8.0",
+				PreviousPackages: previous,
+				Packages:         requested,
+			}
+			if tt.rollback {
+				prepareRollback(state, "components are not healthy")
+			}
+
+			output := strings.Builder{}
+			err := runOrderedUpdate(state, pm, &output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("runOrderedUpdate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if len(pm.Installs) != 1 {
+				t.Fatalf("got %d installs, want 1", len(pm.Installs))
+			}
+			if !reflect.DeepEqual(pm.Installs[0], tt.wantPackages) {
+				t.Errorf("installed %v, want %v", pm.Installs[0], tt.wantPackages)
+			}
+			if pm.Downgrades[0] != tt.wantDowngrade {
+				t.Errorf("allowDowngrade = %v, want %v", pm.Downgrades[0], tt.wantDowngrade)
+			}
+
+			if tt.rollback && (!state.RolledBack || !strings.HasSuffix(state.LogFile, "update-1-rollback.log")) {
+				t.Errorf("rollback state not prepared: rolled back %v, log file %s", state.RolledBack, state.LogFile)
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	tests := []struct {
+		name        string
+		simulateErr error
+		wantErr     bool
+	}{
+		{name: "transaction resolved"},
+		{name: "transaction refused", simulateErr: errors.New("conflicting packages"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm := &FakePackageManager{
+				Components:  []string{"openuem-console"},
+				Installed:   map[string]string{"openuem-console": "0.7.0"},
+				SimulateErr: tt.simulateErr,
+			}
+			us := &UpdaterService{PackageManager: pm, Version: "0.7.0"}
+
+			data := UpdateRequest{}
+			data.Version = "0.8.0"
+
+			report := us.DryRun(data)
+			if (report.Error != "") != tt.wantErr {
+				t.Fatalf("DryRun() error = %q, wantErr %v", report.Error, tt.wantErr)
+			}
+			if len(pm.Installs) != 0 {
+				t.Errorf("dry run installed %v", pm.Installs)
+			}
+		})
+	}
+}
+
+func TestRunOrderedUpdateStartsEveryStep(t *testing.T) {
+	restarted := []string{}
+	systemctlBackup, serviceActiveBackup := systemctl, serviceActive
+	t.Cleanup(func() {
+		systemctl, serviceActive = systemctlBackup, serviceActiveBackup
+	})
+
+	systemctl = func(args ...string) ([]byte, error) {
+		if args[0] == "restart" {
+			restarted = append(restarted, args[1])
+		}
+		return nil, nil
+	}
+
+	// NATS, in the first start step, never gets healthy
+	serviceActive = func(service string) error {
+		if service == "openuem-nats-service" {
+			return errors.New("failed")
+		}
+		return nil
+	}
+
+	state := &UpdateState{
+		Packages:   []Package{{Name: "openuem-console", Version: "0.8.0"}},
+		Components: []string{"NATS", "AgentWorker", "Console"},
+		// Give up on the first health check
+		StepTimeout: time.Nanosecond,
+	}
+
+	output := strings.Builder{}
+	err := runOrderedUpdate(state, &FakePackageManager{}, &output)
+	if err == nil || !strings.Contains(err.Error(), "NATS") {
+		t.Fatalf("runOrderedUpdate() error = %v, want the NATS failure", err)
+	}
+
+	want := []string{"openuem-nats-service", "openuem-agent-worker", "openuem-console"}
+	if !reflect.DeepEqual(restarted, want) {
+		t.Errorf("restarted %v, want %v", restarted, want)
+	}
+}
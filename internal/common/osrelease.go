@@ -0,0 +1,73 @@
+//go:build linux
+
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+const OS_RELEASE_FILE = "/etc/os-release"
+
+// distroFamilies maps os-release IDs with the family that shares its package manager
+var distroFamilies = map[string][]string{
+	"debian": {"debian", "ubuntu", "linuxmint"},
+	"rhel":   {"fedora", "rhel", "redhat", "centos", "almalinux", "rocky"},
+	"suse":   {"suse", "sles", "sled", "opensuse", "opensuse-leap", "opensuse-tumbleweed"},
+	"arch":   {"arch", "archlinux", "manjaro", "endeavouros"},
+}
+
+// GetOSFamily reads the os-release file and returns the distro family using
+// the ID key first and the ID_LIKE key if the ID is not known
+func GetOSFamily() (string, error) {
+	id, idLike, err := readOSRelease(OS_RELEASE_FILE)
+	if err != nil {
+		return "", err
+	}
+
+	for _, candidate := range append([]string{id}, idLike...) {
+		for family, ids := range distroFamilies {
+			if slices.Contains(ids, candidate) {
+				return family, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("distro %s (%s) is not supported", id, strings.Join(idLike, " "))
+}
+
+func readOSRelease(path string) (string, []string, error) {
+	id := ""
+	idLike := []string{}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not open %s, reason: %v", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found {
+			continue
+		}
+		value = strings.ToLower(strings.Trim(value, "\"'"))
+
+		switch key {
+		case "ID":
+			id = value
+		case "ID_LIKE":
+			idLike = strings.Fields(value)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", nil, fmt.Errorf("could not read %s, reason: %v", path, err)
+	}
+
+	return id, idLike, nil
+}
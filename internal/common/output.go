@@ -0,0 +1,146 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// UPDATE_MESSAGE_TAIL is the number of bytes of output stored in the update message
+	UPDATE_MESSAGE_TAIL = 2000
+	// UPDATE_HISTORY_TAIL is the number of bytes of output stored in the update history
+	UPDATE_HISTORY_TAIL = 64 * 1024
+)
+
+type UpdateLogRequest struct {
+	HistoryID int64 `json:"history_id,omitempty"`
+}
+
+type UpdateLogResponse struct {
+	File   string `json:"file,omitempty"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// UpdateLogFile returns the file where the package manager's output is
+// written for an update attempt
+func UpdateLogFile(historyID int64, suffix string) string {
+	return filepath.Join(UpdateLogDirectory(), fmt.Sprintf("update-%d%s.log", historyID, suffix))
+}
+
+// ReadLogTail returns at most the last max bytes of a log file
+func ReadLogTail(path string, max int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	if info.Size() > max {
+		if _, err := f.Seek(-max, io.SeekEnd); err != nil {
+			return "", err
+		}
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	// Seeking may have split a multibyte character
+	return strings.TrimSpace(strings.ToValidUTF8(string(data), "")), nil
+}
+
+// ReadUpdateOutput returns the tail of the output of an update attempt,
+// including the output of its rollback if there was one
+func ReadUpdateOutput(historyID int64) string {
+	output := []string{}
+	for _, suffix := range []string{"", "-rollback"} {
+		tail, err := ReadLogTail(UpdateLogFile(historyID, suffix), UPDATE_HISTORY_TAIL)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("[ERROR]: could not read update log, reason: %v", err)
+			}
+			continue
+		}
+		output = append(output, tail)
+	}
+	return strings.Join(output, "\n")
+}
+
+// WithOutputTail appends the last bytes of the output to the message
+func WithOutputTail(message string, output string) string {
+	if output == "" {
+		return message
+	}
+	if len(output) > UPDATE_MESSAGE_TAIL {
+		output = "..." + strings.ToValidUTF8(output[len(output)-UPDATE_MESSAGE_TAIL:], "")
+	}
+	return message + "\n" + output
+}
+
+// UpdateLogHandler sends the output of an update with NATS request/reply, if
+// no update is requested the most recent log is sent
+func (us *UpdaterService) UpdateLogHandler(msg *nats.Msg) {
+	request := UpdateLogRequest{}
+	response := UpdateLogResponse{}
+
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, &request); err != nil {
+			response.Error = fmt.Sprintf("could not unmarshal log request, reason: %v", err)
+			us.respond(msg, response)
+			return
+		}
+	}
+
+	var logFiles []string
+	var err error
+	if request.HistoryID == 0 {
+		logFiles, err = filepath.Glob(filepath.Join(UpdateLogDirectory(), "update-*.log"))
+	} else {
+		// Only the logs of this update, the rollback log is newer if there's one
+		for _, path := range []string{UpdateLogFile(request.HistoryID, ""), UpdateLogFile(request.HistoryID, "-rollback")} {
+			if _, err := os.Stat(path); err == nil {
+				logFiles = append(logFiles, path)
+			}
+		}
+	}
+	if err != nil || len(logFiles) == 0 {
+		response.Error = "no update log found"
+		us.respond(msg, response)
+		return
+	}
+
+	// Most recent log is the last one modified
+	slices.SortFunc(logFiles, func(a, b string) int {
+		infoA, errA := os.Stat(a)
+		infoB, errB := os.Stat(b)
+		if errA != nil || errB != nil {
+			return strings.Compare(a, b)
+		}
+		return infoA.ModTime().Compare(infoB.ModTime())
+	})
+	response.File = filepath.Base(logFiles[len(logFiles)-1])
+
+	// Leave room for JSON escaping and the rest of the response in the NATS payload
+	max := (us.NATSConnection.MaxPayload() - 1024) / 2
+	response.Output, err = ReadLogTail(logFiles[len(logFiles)-1], max)
+	if err != nil {
+		log.Printf("[ERROR]: could not read update log, reason: %v", err)
+		response.Error = err.Error()
+	}
+
+	us.respond(msg, response)
+}
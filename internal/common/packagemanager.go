@@ -0,0 +1,36 @@
+package common
+
+import "io"
+
+// Package is an OpenUEM package name together with the version we want installed
+type Package struct {
+	Name    string
+	Version string
+}
+
+// PackageManager hides the differences between the package managers that can
+// install OpenUEM server components so ExecuteUpdate doesn't depend on a distro
+type PackageManager interface {
+	// Name returns the name of the package manager, e.g. apt or dnf
+	Name() string
+	// InstalledComponents returns the OpenUEM packages that must be updated in this host
+	InstalledComponents() []string
+	// IsVersionAvailable reports if the repository offers the version for the package
+	IsVersionAvailable(name string, version string) (bool, error)
+	// Install installs the requested versions of the packages writing the
+	// package manager's output, older versions are only installed if
+	// downgrades are allowed
+	Install(packages []Package, allowDowngrade bool, output io.Writer) error
+	// Simulate returns what the package manager would change to install the packages
+	Simulate(packages []Package) (*Transaction, error)
+	// CheckLocks returns an error if another process holds the package database locks
+	CheckLocks() error
+	// InstalledVersion returns the version of the package currently installed
+	InstalledVersion(name string) (string, error)
+	// LatestVersion returns the newest version of the package offered by the repository
+	LatestVersion(name string) (string, error)
+	// RepositoryFiles returns the files that may define the OpenUEM repository
+	RepositoryFiles() []string
+	// Refresh downloads the repository metadata writing the package manager's output
+	Refresh(output io.Writer) error
+}
@@ -0,0 +1,181 @@
+//go:build linux
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// openUEMPackages maps the binaries shipped by every OpenUEM server package
+// with the package name, so we can know which components are installed
+var openUEMPackages = []struct {
+	Name   string
+	Binary string
+}{
+	{Name: "openuem-nats-service", Binary: "/opt/openuem-server/bin/openuem-nats-service"},
+	{Name: "openuem-ocsp-responder", Binary: "/opt/openuem-server/bin/openuem-ocsp-responder"},
+	{Name: "openuem-agent-worker", Binary: "/opt/openuem-server/bin/openuem-agent-worker"},
+	{Name: "openuem-cert-manager-worker", Binary: "/opt/openuem-server/bin/openuem-cert-manager-worker"},
+	{Name: "openuem-notification-worker", Binary: "/opt/openuem-server/bin/openuem-notification-worker"},
+	{Name: "openuem-console", Binary: "/opt/openuem-server/bin/openuem-console"},
+	{Name: "openuem-server-updater", Binary: "/opt/openuem-server/bin/openuem-server-updater"},
+	{Name: "openuem-cert-manager", Binary: "/usr/bin/openuem-cert-manager"},
+}
+
+// installedOpenUEMPackages returns the OpenUEM packages whose binary is present
+func installedOpenUEMPackages() []string {
+	packages := []string{}
+	for _, p := range openUEMPackages {
+		if _, err := os.Stat(p.Binary); err == nil {
+			packages = append(packages, p.Name)
+		}
+	}
+	return packages
+}
+
+// NewPackageManager returns the package manager that must be used for the distro family
+func NewPackageManager(family string) (PackageManager, error) {
+	switch family {
+	case "debian":
+		return &AptPackageManager{}, nil
+	case "rhel":
+		return &DnfPackageManager{}, nil
+	case "suse":
+		return &ZypperPackageManager{}, nil
+	case "arch":
+		return &PacmanPackageManager{}, nil
+	default:
+		return nil, fmt.Errorf("%s family is not supported", family)
+	}
+}
+
+// NewPackageManagerByName returns the package manager with that name, the
+// update runner uses it to install with the package manager the update was
+// prepared with
+func NewPackageManagerByName(name string) (PackageManager, error) {
+	for _, pm := range []PackageManager{&AptPackageManager{}, &DnfPackageManager{}, &ZypperPackageManager{}, &PacmanPackageManager{}} {
+		if pm.Name() == name {
+			return pm, nil
+		}
+	}
+	return nil, fmt.Errorf("%s package manager is not supported", name)
+}
+
+// runInstall runs a package manager command writing its output, it's run by
+// the update runner so the updater can be restarted during the update
+func runInstall(output io.Writer, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Env = append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
+
+	fmt.Fprintf(output, "$ %s\n", cmd.String())
+	log.Println("[INFO]: running update command: ", cmd.String())
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s finished with error: %w", name, err)
+	}
+	return nil
+}
+
+// runQuery runs a package database query and returns its trimmed output
+func runQuery(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("could not run %s %s, reason: %v", name, strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// withoutRelease removes the release suffix of rpm and pacman versions, like
+// the -1 in 0.8.0-1, and the pacman epoch
+func withoutRelease(repoVersion string) string {
+	if _, v, found := strings.Cut(repoVersion, ":"); found {
+		repoVersion = v
+	}
+
+	if i := strings.LastIndex(repoVersion, "-"); i > 0 {
+		return repoVersion[:i]
+	}
+	return repoVersion
+}
+
+// runSimulation runs a package manager in simulation mode, simulations may
+// exit with an error when there are conflicts or the transaction is refused
+// so the output is always returned
+func runSimulation(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if _, ok := err.(*exec.ExitError); ok {
+		return string(out), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not run %s %s, reason: %v", name, strings.Join(args, " "), err)
+	}
+	return string(out), nil
+}
+
+// fillPreviousVersions sets the installed version of the packages that the
+// package manager doesn't report
+func fillPreviousVersions(pm PackageManager, t *Transaction) {
+	for i, p := range t.Packages {
+		if p.From == "" {
+			if version, err := pm.InstalledVersion(p.Name); err == nil {
+				t.Packages[i].From = version
+			}
+		}
+	}
+}
+
+// fcntlLocked returns an error if a process holds a fcntl lock on the file,
+// like dpkg and rpm do with their lock files
+func fcntlLocked(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("could not open %s, reason: %v", path, err)
+	}
+	defer f.Close()
+
+	lock := unix.Flock_t{Type: unix.F_WRLCK, Whence: io.SeekStart}
+	if err := unix.FcntlFlock(f.Fd(), unix.F_GETLK, &lock); err != nil {
+		return fmt.Errorf("could not check lock %s, reason: %v", path, err)
+	}
+
+	if lock.Type != unix.F_UNLCK {
+		return fmt.Errorf("%s is locked by process %d", path, lock.Pid)
+	}
+	return nil
+}
+
+// pidFileLocked returns an error if the pid file belongs to a running
+// process, an empty or invalid pid file doesn't lock anything
+func pidFileLocked(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("could not read %s, reason: %v", path, err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join("/proc", strconv.Itoa(pid))); err == nil {
+		return fmt.Errorf("%s is locked by process %d", path, pid)
+	}
+	return nil
+}
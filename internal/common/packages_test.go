@@ -0,0 +1,42 @@
+//go:build linux
+
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestPidFileLocked(t *testing.T) {
+	tests := []struct {
+		name    string
+		missing bool
+		content string
+		wantErr bool
+	}{
+		{name: "no pid file", missing: true},
+		{name: "empty pid file", content: ""},
+		{name: "whitespace only", content: " \n"},
+		{name: "not a number", content: "pacman\n"},
+		{name: "negative pid", content: "-1\n"},
+		{name: "running process", content: strconv.Itoa(os.Getpid()) + "\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db.lck")
+			if !tt.missing {
+				if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := pidFileLocked(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("pidFileLocked() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
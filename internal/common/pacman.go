@@ -0,0 +1,153 @@
+//go:build linux
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PacmanPackageManager installs OpenUEM on Arch based distributions. Pacman
+// can only install the version offered by the sync database so we refuse to
+// install if that's not the version requested, and downgrades, which need
+// older packages, are refused. Arch doesn't support partial upgrades so the
+// packages are installed with a full system upgrade
+type PacmanPackageManager struct{}
+
+func (pm *PacmanPackageManager) Name() string {
+	return "pacman"
+}
+
+func (pm *PacmanPackageManager) InstalledComponents() []string {
+	return installedOpenUEMPackages()
+}
+
+func (pm *PacmanPackageManager) IsVersionAvailable(name string, version string) (bool, error) {
+	out, err := runQuery("pacman", "-Si", name)
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if found && strings.TrimSpace(key) == "Version" {
+			return matchesVersion(strings.TrimSpace(value), version), nil
+		}
+	}
+	return false, nil
+}
+
+func (pm *PacmanPackageManager) Install(packages []Package, allowDowngrade bool, output io.Writer) error {
+	if allowDowngrade {
+		return fmt.Errorf("pacman can't downgrade or roll back packages, only the versions offered by the repository can be installed")
+	}
+
+	if err := runInstall(output, "pacman", "-Sy"); err != nil {
+		return err
+	}
+
+	args := []string{"-Su", "--noconfirm"}
+	for _, p := range packages {
+		available, err := pm.IsVersionAvailable(p.Name, p.Version)
+		if err != nil {
+			return err
+		}
+		if !available {
+			return fmt.Errorf("pacman can't install %s %s, it's not the version offered by the repository", p.Name, p.Version)
+		}
+		args = append(args, p.Name)
+	}
+	return runInstall(output, "pacman", args...)
+}
+
+func (pm *PacmanPackageManager) Simulate(packages []Package) (*Transaction, error) {
+	t := Transaction{}
+
+	args := []string{"-Su", "--print", "--print-format", "%n %v %s"}
+	for _, p := range packages {
+		available, err := pm.IsVersionAvailable(p.Name, p.Version)
+		if err != nil {
+			return nil, err
+		}
+		if !available {
+			t.Conflicts = append(t.Conflicts, fmt.Sprintf("%s %s is not the version offered by the repository", p.Name, p.Version))
+		}
+		args = append(args, p.Name)
+	}
+
+	out, err := runSimulation("pacman", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(0)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) > 0 && strings.HasPrefix(fields[0], "error:"):
+			t.Conflicts = append(t.Conflicts, strings.TrimSpace(line))
+		case len(fields) == 3:
+			t.Packages = append(t.Packages, PackageChange{Name: fields[0], To: fields[1]})
+			if s, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+				size += s
+			}
+		}
+	}
+	if size > 0 {
+		t.DownloadSize = fmt.Sprintf("%d B", size)
+	}
+	fillPreviousVersions(pm, &t)
+
+	return &t, nil
+}
+
+// CheckLocks fails if pacman's lock file exists, pacman removes it when it exits
+func (pm *PacmanPackageManager) CheckLocks() error {
+	if _, err := os.Stat("/var/lib/pacman/db.lck"); err == nil {
+		return fmt.Errorf("/var/lib/pacman/db.lck exists, another pacman may be running")
+	}
+	return nil
+}
+
+func (pm *PacmanPackageManager) InstalledVersion(name string) (string, error) {
+	out, err := runQuery("pacman", "-Q", name)
+	if err != nil {
+		return "", err
+	}
+
+	// Output is name pkgver-pkgrel, pkgver can't contain hyphens
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return "", fmt.Errorf("unexpected pacman output: %s", out)
+	}
+	version, _, _ := strings.Cut(fields[1], "-")
+	return version, nil
+}
+
+// RepositoryFiles returns no files as the OpenUEM repository is defined in
+// pacman.conf, which is not rewritten by the updater
+func (pm *PacmanPackageManager) RepositoryFiles() []string {
+	return nil
+}
+
+func (pm *PacmanPackageManager) Refresh(output io.Writer) error {
+	return runInstall(output, "pacman", "-Sy")
+}
+
+func (pm *PacmanPackageManager) LatestVersion(name string) (string, error) {
+	out, err := runQuery("pacman", "-Si", name)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if found && strings.TrimSpace(key) == "Version" {
+			return withoutRelease(strings.TrimSpace(value)), nil
+		}
+	}
+	return "", fmt.Errorf("the repository doesn't offer %s", name)
+}
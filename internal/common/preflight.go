@@ -0,0 +1,120 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/open-uem/ent/server"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	PREFLIGHT_DEFAULT_MIN_FREE_MB = 512
+	PREFLIGHT_DEFAULT_RETRY_DELAY = 15 * time.Minute
+	// PREFLIGHT_EVALUATION_RETRY_DELAY is how long an update waits for the
+	// verification of the previous update
+	PREFLIGHT_EVALUATION_RETRY_DELAY = 1 * time.Minute
+)
+
+// PreflightFailure is a check that didn't pass before starting an update,
+// transient failures are expected to go away so the update is retried later
+type PreflightFailure struct {
+	Check     string
+	Reason    string
+	Transient bool
+}
+
+func (f PreflightFailure) String() string {
+	return f.Check + ": " + f.Reason
+}
+
+// ReadPreflightConfig reads the optional [Preflight] section
+func (us *UpdaterService) ReadPreflightConfig(cfg *ini.File) {
+	section := cfg.Section("Preflight")
+
+	us.PreflightMinFreeMB = section.Key("MinFreeMB").MustUint64(PREFLIGHT_DEFAULT_MIN_FREE_MB)
+	us.PreflightRetryDelay = section.Key("RetryDelay").MustDuration(PREFLIGHT_DEFAULT_RETRY_DELAY)
+}
+
+// PreflightChecks checks that the update can be started
+func (us *UpdaterService) PreflightChecks(data UpdateRequest) []PreflightFailure {
+	failures := []PreflightFailure{}
+
+	if us.Model == nil {
+		failures = append(failures, PreflightFailure{Check: "database", Reason: "not connected", Transient: true})
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := us.Model.DB.PingContext(ctx); err != nil {
+			failures = append(failures, PreflightFailure{Check: "database", Reason: err.Error(), Transient: true})
+		}
+		cancel()
+	}
+
+	if us.NATSConnection == nil || !us.NATSConnection.IsConnected() {
+		failures = append(failures, PreflightFailure{Check: "nats", Reason: "not connected", Transient: true})
+	}
+
+	return append(failures, us.PlatformPreflightChecks(data)...)
+}
+
+// RunPreflight runs the pre-flight checks before the update message, if any,
+// is acknowledged. If a check fails the update is retried later when every
+// failure is transient or the message is terminated otherwise. It returns
+// true if the update can go on
+func (us *UpdaterService) RunPreflight(data UpdateRequest, msg jetstream.Msg, channel server.Channel) bool {
+	// The components of the previous update are verified in the background,
+	// the server status belongs to that update until it's evaluated
+	if us.evaluatingUpdate.Load() {
+		log.Printf("[INFO]: the previous update is being verified, update will be retried in %s", PREFLIGHT_EVALUATION_RETRY_DELAY)
+		if err := us.RetryUpdate(data, msg, channel, PREFLIGHT_EVALUATION_RETRY_DELAY); err != nil {
+			log.Printf("[ERROR]: could not retry the update, reason: %v", err)
+		}
+		return false
+	}
+
+	failures := us.PreflightChecks(data)
+	if len(failures) == 0 {
+		return true
+	}
+
+	transient := true
+	reasons := []string{}
+	for _, f := range failures {
+		reasons = append(reasons, f.String())
+		if !f.Transient {
+			transient = false
+		}
+	}
+	reason := strings.Join(reasons, "; ")
+
+	if transient {
+		log.Printf("[INFO]: pre-flight checks failed, update will be retried in %s: %s", us.PreflightRetryDelay, reason)
+		if err := us.RetryUpdate(data, msg, channel, us.PreflightRetryDelay); err != nil {
+			log.Printf("[ERROR]: could not retry the update, reason: %v", err)
+		}
+		message := fmt.Sprintf("pre-flight checks failed, update will be retried in %s: %s", us.PreflightRetryDelay, reason)
+		if us.Model != nil {
+			us.SetUpdateStatus(0, us.Version, channel, server.UpdateStatusPending, message, time.Now().Add(us.PreflightRetryDelay))
+		}
+		us.PublishUpdateEvent(UpdatePhaseScheduled, data.Version, channel, message)
+		return false
+	}
+
+	log.Printf("[ERROR]: pre-flight checks failed: %s", reason)
+	if msg != nil {
+		if err := msg.Term(); err != nil {
+			log.Printf("[ERROR]: could not terminate message, reason: %v", err)
+		}
+	}
+	if us.Model != nil {
+		historyID := us.StartUpdateHistory(data, channel)
+		us.SetUpdateStatus(historyID, data.Version, channel, server.UpdateStatusError, "pre-flight checks failed: "+reason, time.Now())
+	} else {
+		us.PublishUpdateEvent(UpdatePhaseFailed, data.Version, channel, "pre-flight checks failed: "+reason)
+	}
+	return false
+}
@@ -0,0 +1,250 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/open-uem/ent/server"
+)
+
+const NATS_DEFAULT_MONITORING_URL = "http://localhost:8222"
+
+type natsVarz struct {
+	ServerName string `json:"server_name"`
+}
+
+type natsPeer struct {
+	Name    string `json:"name"`
+	Current bool   `json:"current"`
+	Offline bool   `json:"offline"`
+}
+
+// The monitoring endpoint only reports the meta group replicas in the meta
+// leader, the other nodes only know the leader and the cluster size
+type natsJsz struct {
+	Meta *struct {
+		Leader   string     `json:"leader"`
+		Size     int        `json:"cluster_size"`
+		Replicas []natsPeer `json:"replicas"`
+	} `json:"meta_cluster"`
+}
+
+type natsStepDownResponse struct {
+	Success bool `json:"success"`
+	Error   *struct {
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+// errNATSMonitoringUnavailable is returned if the NATS monitoring endpoint
+// can't be queried, retrying doesn't help until NATSMonitoringURL is fixed
+var errNATSMonitoringUnavailable = errors.New("NATS monitoring endpoint is not available")
+
+// PrepareNATSUpdate checks that restarting the NATS node of this server
+// doesn't break the JetStream quorum and moves the stream leaderships away
+// from this node. It runs once the update slot is held so only one server
+// of a rolling update moves its leaderships. The update is retried later if
+// the cluster can't lose this node or refused if the quorum can't be checked,
+// it returns true if the update can go on
+func (us *UpdaterService) PrepareNATSUpdate(data UpdateRequest, msg jetstream.Msg, channel server.Channel) bool {
+	if !us.NATSInstalled || len(strings.Split(us.NATSServers, ",")) < 2 {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	name, err := us.checkNATSQuorum(ctx)
+	if err == nil {
+		us.stepDownNATSLeaderships(ctx, name)
+		return true
+	}
+
+	// Nothing has been installed so the slot is free for the next server
+	us.ReleaseUpdateLease()
+
+	if errors.Is(err, errNATSMonitoringUnavailable) {
+		message := fmt.Sprintf("NATS quorum can't be checked, set NATSMonitoringURL in the [Cluster] section to the monitoring endpoint of the local NATS node: %v", err)
+		log.Printf("[ERROR]: %s", message)
+
+		if msg != nil {
+			if err := msg.Term(); err != nil {
+				log.Printf("[ERROR]: could not terminate message, reason: %v", err)
+			}
+		}
+		if us.Model != nil {
+			historyID := us.StartUpdateHistory(data, channel)
+			us.SetUpdateStatus(historyID, data.Version, channel, server.UpdateStatusError, message, time.Now())
+		} else {
+			us.PublishUpdateEvent(UpdatePhaseFailed, data.Version, channel, message)
+		}
+		return false
+	}
+
+	message := fmt.Sprintf("NATS cluster can't lose this node, update will be retried in %s: %v", us.ClusterRetryDelay, err)
+	log.Printf("[INFO]: %s", message)
+
+	if err := us.RetryUpdate(data, msg, channel, us.ClusterRetryDelay); err != nil {
+		log.Printf("[ERROR]: could not retry the update, reason: %v", err)
+	}
+
+	if us.Model != nil {
+		us.SetUpdateStatus(0, us.Version, channel, server.UpdateStatusPending, message, time.Now().Add(us.ClusterRetryDelay))
+	}
+	us.PublishUpdateEvent(UpdatePhaseScheduled, data.Version, channel, message)
+	return false
+}
+
+// checkNATSQuorum returns the name of the local NATS node if every raft
+// group this node belongs to keeps its quorum without it
+func (us *UpdaterService) checkNATSQuorum(ctx context.Context) (string, error) {
+	js := us.GetJetStream()
+	if js == nil {
+		return "", errors.New("JetStream is not available until NATS is connected")
+	}
+
+	varz := natsVarz{}
+	if err := us.getNATSMonitoring(ctx, "/varz", &varz); err != nil {
+		return "", err
+	}
+
+	jsz := natsJsz{}
+	if err := us.getNATSMonitoring(ctx, "/jsz", &jsz); err != nil {
+		return "", err
+	}
+
+	if jsz.Meta == nil || jsz.Meta.Size < 2 {
+		return varz.ServerName, nil
+	}
+
+	if jsz.Meta.Leader == "" {
+		return "", errors.New("JetStream has no meta leader")
+	}
+
+	// Peers that are offline or behind can't be counted for the quorum
+	unhealthy := map[string]bool{}
+	for _, p := range jsz.Meta.Replicas {
+		if p.Name != varz.ServerName && (p.Offline || !p.Current) {
+			unhealthy[p.Name] = true
+		}
+	}
+
+	streams := js.ListStreams(ctx)
+	for info := range streams.Info() {
+		if info.Cluster == nil || len(info.Cluster.Replicas) == 0 {
+			continue
+		}
+
+		if info.Cluster.Leader == "" {
+			return "", fmt.Errorf("stream %s has no leader", info.Config.Name)
+		}
+
+		member := info.Cluster.Leader == varz.ServerName
+		healthy := 0
+		if !member {
+			healthy++
+		}
+
+		for _, p := range info.Cluster.Replicas {
+			if p.Name == varz.ServerName {
+				member = true
+				continue
+			}
+			if p.Offline || !p.Current {
+				unhealthy[p.Name] = true
+				continue
+			}
+			healthy++
+		}
+
+		size := len(info.Cluster.Replicas) + 1
+		if member && healthy < size/2+1 {
+			return "", fmt.Errorf("stream %s would lose its quorum, %d of %d replicas would be available", info.Config.Name, healthy, size)
+		}
+	}
+	if err := streams.Err(); err != nil {
+		return "", err
+	}
+
+	available := jsz.Meta.Size - len(unhealthy) - 1
+	if available < jsz.Meta.Size/2+1 {
+		return "", fmt.Errorf("JetStream meta group would lose its quorum, %d of %d servers would be available", available, jsz.Meta.Size)
+	}
+
+	return varz.ServerName, nil
+}
+
+// stepDownNATSLeaderships asks the streams led by this node to elect another
+// leader. Failures are logged as the cluster elects new leaders anyway when
+// the node stops. The JetStream meta leader is not asked to step down as that
+// is only allowed to the system account, which the updater doesn't use, the
+// meta group elects a new leader once this node stops
+func (us *UpdaterService) stepDownNATSLeaderships(ctx context.Context, name string) {
+	streams := us.GetJetStream().ListStreams(ctx)
+	for info := range streams.Info() {
+		if info.Cluster == nil || len(info.Cluster.Replicas) == 0 || info.Cluster.Leader != name {
+			continue
+		}
+
+		if err := us.natsStepDown(jetstream.DefaultAPIPrefix + "STREAM.LEADER.STEPDOWN." + info.Config.Name); err != nil {
+			log.Printf("[ERROR]: could not step down as leader of stream %s, reason: %v", info.Config.Name, err)
+			continue
+		}
+		log.Printf("[INFO]: stepped down as leader of stream %s", info.Config.Name)
+	}
+	if err := streams.Err(); err != nil {
+		log.Printf("[ERROR]: could not list streams, reason: %v", err)
+	}
+}
+
+func (us *UpdaterService) natsStepDown(subject string) error {
+	reply, err := us.NATSConnection.Request(subject, nil, 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	response := natsStepDownResponse{}
+	if err := json.Unmarshal(reply.Data, &response); err != nil {
+		return err
+	}
+
+	if response.Error != nil {
+		return errors.New(response.Error.Description)
+	}
+
+	if !response.Success {
+		return errors.New("leader did not step down")
+	}
+	return nil
+}
+
+func (us *UpdaterService) getNATSMonitoring(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(us.NATSMonitoringURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w at %s, reason: %v", errNATSMonitoringUnavailable, us.NATSMonitoringURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w at %s, it returned %s", errNATSMonitoringUnavailable, us.NATSMonitoringURL, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,149 @@
+//go:build linux
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/open-uem/ent/server"
+)
+
+// SwitchRepositoryChannel points the OpenUEM repository definition to the
+// new channel and refreshes the metadata, the previous definition is
+// restored if the package manager can't read the new one. It returns the
+// function that restores the previous definition if a later step fails
+func (us *UpdaterService) SwitchRepositoryChannel(from server.Channel, to server.Channel) (func() error, error) {
+	pm, err := us.GetPackageManager()
+	if err != nil {
+		return nil, err
+	}
+
+	files := pm.RepositoryFiles()
+	if us.RepositoryFile != "" {
+		files = []string{us.RepositoryFile}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("the OpenUEM repository can't be switched with %s", pm.Name())
+	}
+
+	originals, err := rewriteRepositoryChannel(files, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	output := strings.Builder{}
+	if err := pm.Refresh(&output); err != nil {
+		if err := restoreRepositoryFiles(originals); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("could not refresh the repository metadata, reason: %v %s", err, strings.TrimSpace(output.String()))
+	}
+
+	restore := func() error {
+		if err := restoreRepositoryFiles(originals); err != nil {
+			return err
+		}
+
+		output := strings.Builder{}
+		if err := pm.Refresh(&output); err != nil {
+			return fmt.Errorf("could not refresh the repository metadata, reason: %v %s", err, strings.TrimSpace(output.String()))
+		}
+		return nil
+	}
+	return restore, nil
+}
+
+func restoreRepositoryFiles(originals map[string][]byte) error {
+	for file, data := range originals {
+		if err := writeFileAtomically(file, data); err != nil {
+			return fmt.Errorf("could not restore %s, reason: %v", file, err)
+		}
+	}
+	return nil
+}
+
+// rewriteRepositoryChannel replaces the channel token in the repository
+// files that exist and returns their previous content
+func rewriteRepositoryChannel(files []string, from server.Channel, to server.Channel) (map[string][]byte, error) {
+	token := regexp.MustCompile(`(^|[^A-Za-z0-9])` + regexp.QuoteMeta(string(from)) + `([^A-Za-z0-9]|$)`)
+
+	originals := map[string][]byte{}
+	rewritten := map[string][]byte{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+
+		lines := strings.Split(string(data), "\n")
+		changed := false
+		for i, line := range lines {
+			if strings.HasPrefix(strings.TrimSpace(line), "#") || !token.MatchString(line) {
+				continue
+			}
+			// Adjacent tokens share a separator, so replace until none is left
+			for token.MatchString(lines[i]) {
+				lines[i] = token.ReplaceAllString(lines[i], "${1}"+string(to)+"${2}")
+			}
+			changed = true
+		}
+
+		if changed {
+			originals[file] = data
+			rewritten[file] = []byte(strings.Join(lines, "\n"))
+		}
+	}
+
+	if len(rewritten) == 0 {
+		return nil, fmt.Errorf("no OpenUEM repository definition uses the %s channel in %s", from, strings.Join(files, ", "))
+	}
+
+	for file, data := range rewritten {
+		if err := writeFileAtomically(file, data); err != nil {
+			for file, data := range originals {
+				_ = writeFileAtomically(file, data)
+			}
+			return nil, err
+		}
+	}
+	return originals, nil
+}
+
+// writeFileAtomically replaces the file keeping its permissions so the
+// package manager never reads a partially written definition
+func writeFileAtomically(file string, data []byte) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
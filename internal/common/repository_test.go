@@ -0,0 +1,108 @@
+//go:build linux
+
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/open-uem/ent/server"
+)
+
+func TestRewriteRepositoryChannel(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "apt source",
+			content: "deb [signed-by=/etc/apt/keyrings/openuem.gpg] https://repo.openuem.eu/deb stable main\n",
+			want:    "deb [signed-by=/etc/apt/keyrings/openuem.gpg] https://repo.openuem.eu/deb testing main\n",
+		},
+		{
+			name:    "rpm repository",
+			content: "[openuem-stable]\nname=OpenUEM stable\nbaseurl=https://repo.openuem.eu/rpm/stable/$basearch\n",
+			want:    "[openuem-testing]\nname=OpenUEM testing\nbaseurl=https://repo.openuem.eu/rpm/testing/$basearch\n",
+		},
+		{
+			name:    "comments and longer words are kept",
+			content: "# stable channel\ndeb https://repo.openuem.eu/deb stable main\ndeb https://mirror.example.com/unstable main\n",
+			want:    "# stable channel\ndeb https://repo.openuem.eu/deb testing main\ndeb https://mirror.example.com/unstable main\n",
+		},
+		{
+			name:    "channel not used",
+			content: "deb https://repo.openuem.eu/deb devel main\n",
+			want:    "deb https://repo.openuem.eu/deb devel main\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "openuem.list")
+			if err := os.WriteFile(file, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			// A missing file is skipped as each package manager lists every
+			// place the definition may be
+			files := []string{filepath.Join(dir, "missing.list"), file}
+
+			originals, err := rewriteRepositoryChannel(files, server.ChannelStable, server.ChannelTesting)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rewriteRepositoryChannel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("rewritten file is %q, want %q", data, tt.want)
+			}
+
+			if !tt.wantErr && string(originals[file]) != tt.content {
+				t.Errorf("original content is %q, want %q", originals[file], tt.content)
+			}
+
+			info, err := os.Stat(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0644 {
+				t.Errorf("file mode is %v, want 0644", info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestSwitchRepositoryChannelRestore(t *testing.T) {
+	content := "deb https://repo.openuem.eu/deb stable main\n"
+	file := filepath.Join(t.TempDir(), "openuem.list")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	us := &UpdaterService{PackageManager: &FakePackageManager{RepositoryPaths: []string{file}}}
+	restore, err := us.SwitchRepositoryChannel(server.ChannelStable, server.ChannelTesting)
+	if err != nil {
+		t.Fatalf("SwitchRepositoryChannel() error = %v", err)
+	}
+
+	// The config file couldn't be saved, so the switch is undone
+	if err := restore(); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("restored file is %q, want %q", data, content)
+	}
+}
@@ -0,0 +1,25 @@
+package common
+
+import (
+	openuem_nats "github.com/open-uem/nats"
+)
+
+// UpdateRequest is the update request sent by the console, it extends the
+// request with fields that only the server updater understands
+type UpdateRequest struct {
+	openuem_nats.OpenUEMUpdateRequest
+	RequestedBy string `json:"requested_by,omitempty"`
+	DryRun      bool   `json:"dry_run,omitempty"`
+	// RejectOutsideWindow rejects the update instead of deferring it to the
+	// next maintenance window
+	RejectOutsideWindow bool `json:"reject_outside_window,omitempty"`
+	// The version policy refuses downgrades, skipped major versions and
+	// pre-release versions on the stable channel unless overridden
+	AllowDowngrade  bool `json:"allow_downgrade,omitempty"`
+	AllowMajorSkip  bool `json:"allow_major_skip,omitempty"`
+	AllowPrerelease bool `json:"allow_prerelease,omitempty"`
+	// A signed release manifest, or the url to get it, sets the version of
+	// each component and the installer instead of Version and DownloadFrom
+	Manifest    *SignedManifest `json:"manifest,omitempty"`
+	ManifestURL string          `json:"manifest_url,omitempty"`
+}
@@ -0,0 +1,209 @@
+//go:build linux
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	UPDATER_SERVICE       = "openuem-server-updater"
+	RUNNER_WAIT_TIMEOUT   = 60 * time.Minute
+	RUNNER_STATE_FILENAME = "runner-state.json"
+)
+
+// RunnerState is written by the update runner so the updater knows when the
+// package manager ran and how it exited once it's restarted
+type RunnerState struct {
+	Unit      string    `json:"unit"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at,omitempty"`
+	ExitCode  int       `json:"exit_code"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func (rs *RunnerState) Finished() bool {
+	return !rs.EndedAt.IsZero()
+}
+
+func RunnerStateFile() string {
+	return filepath.Join(filepath.Dir(UpdateStateFile()), RUNNER_STATE_FILENAME)
+}
+
+func saveRunnerState(rs *RunnerState) error {
+	data, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(RunnerStateFile(), data, 0600)
+}
+
+// LoadRunnerState returns the state written by the update runner or nil if the runner didn't start
+func LoadRunnerState() (*RunnerState, error) {
+	data, err := os.ReadFile(RunnerStateFile())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	rs := RunnerState{}
+	if err := json.Unmarshal(data, &rs); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+func RemoveRunnerState() {
+	if err := os.Remove(RunnerStateFile()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("[ERROR]: could not remove runner state, reason: %v", err)
+	}
+}
+
+// StartUpdateRunner runs this executable with the run-update argument in a
+// transient systemd unit, so the package manager keeps running when the
+// updater is restarted by the packages being installed
+func StartUpdateRunner(state *UpdateState) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("could not get updater executable, reason: %v", err)
+	}
+
+	RemoveRunnerState()
+
+	state.RunnerUnit = fmt.Sprintf("openuem-server-update-%d", time.Now().Unix())
+	if err := SaveUpdateState(state); err != nil {
+		return fmt.Errorf("could not save update state, reason: %v", err)
+	}
+
+	out, err := exec.Command("systemd-run", "--unit="+state.RunnerUnit, "--collect", "--quiet", "--service-type=exec", executable, "run-update").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("could not start update runner, reason: %v %s", err, strings.TrimSpace(string(out)))
+	}
+	log.Printf("[INFO]: update runner has been started in unit %s", state.RunnerUnit)
+
+	return nil
+}
+
+// RunUpdate is the update runner, it installs the packages in the update
+// state, writes how the package manager exited and restarts the updater so
+// the update can be evaluated. It returns the exit code for the process
+func RunUpdate() int {
+	state, err := LoadUpdateState()
+	if err != nil || state == nil {
+		log.Printf("[ERROR]: could not find an update to run, reason: %v", err)
+		return 1
+	}
+
+	rs := RunnerState{Unit: state.RunnerUnit, StartedAt: time.Now()}
+	if err := saveRunnerState(&rs); err != nil {
+		log.Printf("[ERROR]: could not save runner state, reason: %v", err)
+		return 1
+	}
+
+	if err := os.MkdirAll(UpdateLogDirectory(), 0750); err != nil {
+		log.Printf("[ERROR]: could not create update log directory, reason: %v", err)
+	}
+
+	output, err := os.OpenFile(state.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		log.Printf("[ERROR]: could not open update log, reason: %v", err)
+		output = os.Stdout
+	} else {
+		defer output.Close()
+	}
+
+	err = runPackageManager(state, output)
+	if err != nil {
+		rs.ExitCode = 1
+		rs.Error = err.Error()
+
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			rs.ExitCode = exitErr.ExitCode()
+		}
+		fmt.Fprintf(output, "%v\n", err)
+	}
+	rs.EndedAt = time.Now()
+
+	if err := saveRunnerState(&rs); err != nil {
+		log.Printf("[ERROR]: could not save runner state, reason: %v", err)
+	}
+
+	// The updater evaluates the update when it starts
+	if err := exec.Command("systemctl", "restart", UPDATER_SERVICE).Run(); err != nil {
+		log.Printf("[ERROR]: could not restart the updater, reason: %v", err)
+	}
+
+	return rs.ExitCode
+}
+
+// runnerPackageManager returns the package manager the updater prepared the
+// update with, or the one of the distro family for updates prepared by an
+// older updater. Tests replace it to run the update with a fake
+var runnerPackageManager = func(state *UpdateState) (PackageManager, error) {
+	if state.PackageManager != "" {
+		return NewPackageManagerByName(state.PackageManager)
+	}
+
+	family, err := GetOSFamily()
+	if err != nil {
+		return nil, err
+	}
+	return NewPackageManager(family)
+}
+
+func runPackageManager(state *UpdateState, output io.Writer) error {
+	pm, err := runnerPackageManager(state)
+	if err != nil {
+		return err
+	}
+
+	return runOrderedUpdate(state, pm, output)
+}
+
+// WaitForRunner waits until the update runner has finished, as the updater
+// may have been restarted by the package manager while it was still running
+func WaitForRunner(state *UpdateState) (*RunnerState, error) {
+	if state.RunnerUnit == "" {
+		return nil, nil
+	}
+
+	deadline := time.Now().Add(RUNNER_WAIT_TIMEOUT)
+	for {
+		rs, err := LoadRunnerState()
+		if err != nil {
+			return nil, fmt.Errorf("could not read runner state, reason: %v", err)
+		}
+
+		if rs != nil && rs.Finished() {
+			return rs, nil
+		}
+
+		if err := ServiceActive(state.RunnerUnit); err != nil {
+			// Give the runner a moment to write its state before giving up
+			time.Sleep(5 * time.Second)
+			if rs, err := LoadRunnerState(); err == nil && rs != nil && rs.Finished() {
+				return rs, nil
+			}
+			return rs, fmt.Errorf("update runner %s stopped without finishing", state.RunnerUnit)
+		}
+
+		if time.Now().After(deadline) {
+			return rs, fmt.Errorf("update runner %s didn't finish in %s", state.RunnerUnit, RUNNER_WAIT_TIMEOUT)
+		}
+
+		log.Printf("[INFO]: waiting for update runner %s to finish", state.RunnerUnit)
+		time.Sleep(10 * time.Second)
+	}
+}
@@ -0,0 +1,69 @@
+//go:build linux
+
+package common
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunPackageManager(t *testing.T) {
+	pm := &FakePackageManager{}
+	runnerPackageManagerBackup := runnerPackageManager
+	t.Cleanup(func() {
+		runnerPackageManager = runnerPackageManagerBackup
+	})
+
+	// The runner must install with the package manager the update was prepared with
+	runnerPackageManager = func(state *UpdateState) (PackageManager, error) {
+		if state.PackageManager != pm.Name() {
+			return nil, errors.New("unexpected package manager " + state.PackageManager)
+		}
+		return pm, nil
+	}
+
+	previous := []Package{{Name: "openuem-console", Version: "0.7.0"}}
+	requested := []Package{{Name: "openuem-console", Version: "0.8.0"}}
+	state := &UpdateState{
+		HistoryID:        1,
+		Version:          "0.8.0",
+		PreviousPackages: previous,
+		Packages:         requested,
+		PackageManager:   pm.Name(),
+	}
+
+	output := strings.Builder{}
+	if err := runPackageManager(state, &output); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	prepareRollback(state, "components are not healthy")
+	if err := runPackageManager(state, &output); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+
+	if want := [][]Package{requested, previous}; !reflect.DeepEqual(pm.Installs, want) {
+		t.Errorf("installed %v, want %v", pm.Installs, want)
+	}
+	if want := []bool{false, true}; !reflect.DeepEqual(pm.Downgrades, want) {
+		t.Errorf("allowDowngrade = %v, want %v", pm.Downgrades, want)
+	}
+}
+
+func TestNewPackageManagerByName(t *testing.T) {
+	for _, name := range []string{"apt", "dnf", "zypper", "pacman"} {
+		pm, err := NewPackageManagerByName(name)
+		if err != nil {
+			t.Fatalf("NewPackageManagerByName(%s) error = %v", name, err)
+		}
+		if pm.Name() != name {
+			t.Errorf("NewPackageManagerByName(%s) = %s", name, pm.Name())
+		}
+	}
+
+	if _, err := NewPackageManagerByName("fake"); err == nil {
+		t.Error("the fake package manager can't be used by the update runner")
+	}
+}
@@ -0,0 +1,364 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/open-uem/ent/server"
+	"github.com/open-uem/openuem-server-updater/internal/models"
+)
+
+// PendingUpdate is an update waiting in the task scheduler for its time. The
+// request is stored in the database, so the message is acknowledged as soon
+// as it's scheduled and the schedule survives restarts
+type PendingUpdate struct {
+	ID          int64          `json:"id"`
+	Version     string         `json:"version"`
+	Channel     server.Channel `json:"channel"`
+	UpdateAt    time.Time      `json:"update_at"`
+	RequestedBy string         `json:"requested_by,omitempty"`
+	request     UpdateRequest
+	job         gocron.Job
+}
+
+// UpdateControlRequest cancels or moves a pending update, the ID can be
+// omitted if only one update is pending
+type UpdateControlRequest struct {
+	ID       int64     `json:"id,omitempty"`
+	UpdateAt time.Time `json:"update_at,omitempty"`
+}
+
+// SchedulePendingUpdate stores the update request and registers a one time
+// job that runs it at data.UpdateAt. The stream sequence of the request, zero
+// if the request doesn't come from a message, prevents scheduling a
+// redelivered request twice
+func (us *UpdaterService) SchedulePendingUpdate(data UpdateRequest, channel server.Channel, streamSequence uint64) error {
+	if us.Model == nil {
+		return errors.New("the database is not connected")
+	}
+
+	request, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	id, created, err := us.Model.SaveScheduledUpdate(channel, request, data.UpdateAt, streamSequence)
+	if err != nil {
+		return err
+	}
+
+	if !created {
+		log.Printf("[INFO]: update request %d is already scheduled", streamSequence)
+		return nil
+	}
+
+	if err := us.registerPendingUpdate(id, data, channel); err != nil {
+		if err := us.Model.DeleteScheduledUpdate(id); err != nil {
+			log.Printf("[ERROR]: could not remove scheduled update, reason: %v", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// RestorePendingUpdates rebuilds the schedule from the updates stored in the
+// database. Updates whose time passed while the updater was stopped run now
+// or in the next maintenance window
+func (us *UpdaterService) RestorePendingUpdates() {
+	scheduled, err := us.Model.GetScheduledUpdates()
+	if err != nil {
+		log.Printf("[ERROR]: could not get scheduled updates, reason: %v", err)
+		return
+	}
+
+	for _, s := range scheduled {
+		us.pendingMutex.Lock()
+		_, ok := us.pendingUpdates[s.ID]
+		us.pendingMutex.Unlock()
+		if ok {
+			continue
+		}
+
+		data := UpdateRequest{}
+		if err := json.Unmarshal(s.Request, &data); err != nil {
+			log.Printf("[ERROR]: could not unmarshal scheduled update %d, reason: %v", s.ID, err)
+			continue
+		}
+
+		data.UpdateAt = s.UpdateAt
+		if data.UpdateAt.Before(time.Now()) && us.Maintenance != nil {
+			if slot, err := us.Maintenance.NextSlot(time.Now()); err == nil {
+				data.UpdateAt = slot
+			}
+		}
+
+		if err := us.registerPendingUpdate(s.ID, data, s.Channel); err != nil {
+			log.Printf("[ERROR]: could not schedule the update task: %v", err)
+			continue
+		}
+		log.Printf("[INFO]: scheduled update to %s at %s has been restored", data.Version, data.UpdateAt.String())
+	}
+}
+
+func (us *UpdaterService) registerPendingUpdate(id int64, data UpdateRequest, channel server.Channel) error {
+	us.pendingMutex.Lock()
+	defer us.pendingMutex.Unlock()
+
+	if us.pendingUpdates == nil {
+		us.pendingUpdates = map[int64]*PendingUpdate{}
+	}
+
+	job, err := us.TaskScheduler.NewJob(
+		oneTimeJobAt(data.UpdateAt),
+		gocron.NewTask(func() {
+			us.runPendingUpdate(id)
+		}),
+	)
+	if err != nil {
+		return err
+	}
+
+	us.pendingUpdates[id] = &PendingUpdate{
+		ID:          id,
+		Version:     data.Version,
+		Channel:     channel,
+		UpdateAt:    data.UpdateAt,
+		RequestedBy: data.RequestedBy,
+		request:     data,
+		job:         job,
+	}
+	return nil
+}
+
+// oneTimeJobAt starts the job immediately if its time already passed as
+// gocron refuses start times in the past
+func oneTimeJobAt(t time.Time) gocron.JobDefinition {
+	if !t.After(time.Now()) {
+		return gocron.OneTimeJob(gocron.OneTimeJobStartImmediately())
+	}
+	return gocron.OneTimeJob(gocron.OneTimeJobStartDateTime(t))
+}
+
+func (us *UpdaterService) runPendingUpdate(id int64) {
+	us.pendingMutex.Lock()
+	p, ok := us.pendingUpdates[id]
+	delete(us.pendingUpdates, id)
+	us.pendingMutex.Unlock()
+
+	// The update was cancelled while the job was starting
+	if !ok {
+		return
+	}
+
+	if err := us.Model.DeleteScheduledUpdate(id); err != nil {
+		log.Printf("[ERROR]: could not remove scheduled update, reason: %v", err)
+	}
+
+	us.ExecuteUpdate(p.request, nil, p.Version, p.Channel)
+}
+
+// RetryUpdate tries the update again after the delay. If the update still
+// has its message the message is redelivered and goes through the
+// maintenance windows again, otherwise the update is scheduled again in the
+// next maintenance window
+func (us *UpdaterService) RetryUpdate(data UpdateRequest, msg jetstream.Msg, channel server.Channel, delay time.Duration) error {
+	if msg != nil {
+		return msg.NakWithDelay(delay)
+	}
+
+	data.UpdateNow = false
+	data.UpdateAt = time.Now().Add(delay)
+	if us.Maintenance != nil {
+		slot, err := us.Maintenance.NextSlot(data.UpdateAt)
+		if err != nil {
+			return err
+		}
+		data.UpdateAt = slot
+	}
+	return us.SchedulePendingUpdate(data, channel, 0)
+}
+
+// PendingUpdates returns the updates waiting for their time, sorted by time
+func (us *UpdaterService) PendingUpdates() []PendingUpdate {
+	us.pendingMutex.Lock()
+	defer us.pendingMutex.Unlock()
+
+	pending := []PendingUpdate{}
+	for _, p := range us.pendingUpdates {
+		pending = append(pending, *p)
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].UpdateAt.Before(pending[j].UpdateAt)
+	})
+	return pending
+}
+
+// findPendingUpdate must be called with the pending mutex held
+func (us *UpdaterService) findPendingUpdate(id int64) (*PendingUpdate, error) {
+	if id != 0 {
+		p, ok := us.pendingUpdates[id]
+		if !ok {
+			return nil, fmt.Errorf("there is no pending update with id %d", id)
+		}
+		return p, nil
+	}
+
+	switch len(us.pendingUpdates) {
+	case 0:
+		return nil, errors.New("there are no pending updates")
+	case 1:
+		for _, p := range us.pendingUpdates {
+			return p, nil
+		}
+	}
+	return nil, errors.New("there are several pending updates, the update id is required")
+}
+
+// CancelPendingUpdate removes the job of a pending update and its request
+func (us *UpdaterService) CancelPendingUpdate(id int64) error {
+	us.pendingMutex.Lock()
+	p, err := us.findPendingUpdate(id)
+	if err != nil {
+		us.pendingMutex.Unlock()
+		return err
+	}
+	delete(us.pendingUpdates, p.ID)
+	us.pendingMutex.Unlock()
+
+	if err := us.TaskScheduler.RemoveJob(p.job.ID()); err != nil && !errors.Is(err, gocron.ErrJobNotFound) {
+		log.Printf("[ERROR]: could not remove the update task, reason: %v", err)
+	}
+
+	if err := us.Model.DeleteScheduledUpdate(p.ID); err != nil {
+		log.Printf("[ERROR]: could not remove scheduled update, reason: %v", err)
+	}
+
+	message := fmt.Sprintf("update to %s scheduled at %s was cancelled", p.Version, p.UpdateAt.Format(time.RFC3339))
+	historyID := us.StartUpdateHistory(p.request, p.Channel)
+	if historyID != 0 {
+		if err := us.Model.FinishUpdateHistory(historyID, models.UpdateHistoryStatusCancelled, message, ""); err != nil {
+			log.Printf("[ERROR]: could not save update history, reason: %v", err)
+		}
+	}
+
+	if err := us.Model.ClearServerUpdateStatus(us.Version, message); err != nil {
+		log.Printf("[ERROR]: could not save server status, reason: %v", err)
+	}
+
+	us.PublishUpdateEvent(UpdatePhaseCancelled, p.Version, p.Channel, message)
+	log.Printf("[INFO]: %s", message)
+	return nil
+}
+
+// ReschedulePendingUpdate moves a pending update to a new time, the time is
+// moved to the next maintenance window like new requests are
+func (us *UpdaterService) ReschedulePendingUpdate(id int64, updateAt time.Time) error {
+	if updateAt.IsZero() {
+		return errors.New("the new update time is required")
+	}
+
+	if err := us.ValidateUpdateAt(updateAt); err != nil {
+		return err
+	}
+
+	if updateAt.Before(time.Now()) {
+		updateAt = time.Now()
+	}
+
+	if us.Model == nil {
+		return errors.New("the database is not connected")
+	}
+
+	us.pendingMutex.Lock()
+	defer us.pendingMutex.Unlock()
+
+	p, err := us.findPendingUpdate(id)
+	if err != nil {
+		return err
+	}
+
+	if us.Maintenance != nil {
+		slot, err := us.Maintenance.NextSlot(updateAt)
+		if err != nil {
+			return err
+		}
+		if p.request.RejectOutsideWindow && !slot.Equal(updateAt) {
+			return fmt.Errorf("update time %s is outside the maintenance windows", updateAt.Format(time.RFC3339))
+		}
+		updateAt = slot
+	}
+
+	data := p.request
+	data.UpdateAt = updateAt
+	request, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if err := us.Model.RescheduleUpdate(p.ID, request, updateAt); err != nil {
+		return err
+	}
+
+	pendingID := p.ID
+	job, err := us.TaskScheduler.Update(
+		p.job.ID(),
+		oneTimeJobAt(updateAt),
+		gocron.NewTask(func() {
+			us.runPendingUpdate(pendingID)
+		}),
+	)
+	if err != nil {
+		return err
+	}
+
+	p.job = job
+	p.UpdateAt = updateAt
+	p.request = data
+
+	message := "update rescheduled at " + updateAt.Format(time.RFC3339)
+	us.SetUpdateStatus(0, us.Version, p.Channel, server.UpdateStatusPending, message, updateAt)
+	us.PublishUpdateEvent(UpdatePhaseScheduled, p.Version, p.Channel, message)
+	log.Printf("[INFO]: %s", message)
+	return nil
+}
+
+// UpdateControlHandler handles the cancel and reschedule messages, they're
+// acknowledged even if they fail as retrying them wouldn't help
+func (us *UpdaterService) UpdateControlHandler(msg jetstream.Msg, operation string) {
+	if err := msg.Ack(); err != nil {
+		log.Printf("[ERROR]: could not ACK message, reason: %v", err)
+	}
+
+	request := UpdateControlRequest{}
+	if len(msg.Data()) > 0 {
+		if err := json.Unmarshal(msg.Data(), &request); err != nil {
+			log.Printf("[ERROR]: could not unmarshal %s request, reason: %v", operation, err)
+			return
+		}
+	}
+
+	var err error
+	switch operation {
+	case "cancel":
+		err = us.CancelPendingUpdate(request.ID)
+	case "reschedule":
+		err = us.ReschedulePendingUpdate(request.ID, request.UpdateAt)
+	}
+
+	if err != nil {
+		log.Printf("[ERROR]: could not %s the pending update, reason: %v", operation, err)
+	}
+}
+
+// PendingUpdatesHandler answers with the list of pending updates
+func (us *UpdaterService) PendingUpdatesHandler(msg *nats.Msg) {
+	us.respond(msg, us.PendingUpdates())
+}
@@ -0,0 +1,282 @@
+package common
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/open-uem/ent/server"
+	"github.com/open-uem/openuem-server-updater/internal/models"
+	"github.com/open-uem/utils"
+	"gopkg.in/ini.v1"
+)
+
+// Requests are signed by the console with a certificate issued by the CA.
+// The signature covers the subject, the timestamp, the nonce and the body so
+// a signed request can't be sent to another server or replayed
+const (
+	SIGNATURE_HEADER           = "OpenUEM-Signature"
+	SIGNER_HEADER              = "OpenUEM-Signer"
+	NONCE_HEADER               = "OpenUEM-Nonce"
+	TIMESTAMP_HEADER           = "OpenUEM-Timestamp"
+	NONCES_BUCKET              = "SERVER_UPDATE_NONCES"
+	SIGNATURE_DEFAULT_MAX_SKEW = 5 * time.Minute
+)
+
+var nonceRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{16,128}$`)
+
+// ReadSecurityConfig reads the optional [Security] section. Signers is the
+// list of common names allowed to sign requests and release manifests, any
+// certificate issued by the CA can sign them if it's empty
+func (us *UpdaterService) ReadSecurityConfig(cfg *ini.File) error {
+	section := cfg.Section("Security")
+
+	us.RequireSignedRequests = section.Key("RequireSignedRequests").MustBool(true)
+	us.SignatureMaxSkew = section.Key("MaxSkew").MustDuration(SIGNATURE_DEFAULT_MAX_SKEW)
+	us.Signers = splitList(section.Key("Signers").String())
+
+	// Release manifests are always signed so the CA is needed anyway
+	ca, err := utils.ReadPEMCertificate(us.CACert)
+	if err != nil {
+		return fmt.Errorf("could not read CA certificate, reason: %v", err)
+	}
+
+	us.signerRoots = x509.NewCertPool()
+	us.signerRoots.AddCert(ca)
+
+	if !us.RequireSignedRequests {
+		log.Println("[INFO]: signed requests are not required, any NATS client can request updates")
+	}
+	return nil
+}
+
+// CreateNonceStore creates the KV bucket that remembers the nonces of the
+// requests until their timestamp is too old to be accepted anyway
+func (us *UpdaterService) CreateNonceStore(ctx context.Context, js jetstream.JetStream, replicas int) error {
+	if !us.RequireSignedRequests {
+		return nil
+	}
+
+	config := jetstream.KeyValueConfig{
+		Bucket:  NONCES_BUCKET,
+		TTL:     2*us.SignatureMaxSkew + time.Minute,
+		History: 1,
+	}
+
+	if replicas > 1 {
+		config.Replicas = min(replicas, 5)
+	}
+
+	kv, err := js.CreateOrUpdateKeyValue(ctx, config)
+	if err != nil {
+		return err
+	}
+	us.nonces = kv
+	return nil
+}
+
+// VerifyJetStreamMessage verifies the signature of an update or control
+// message. The timestamp is compared with the time the message was stored in
+// the stream so a redelivered message is still valid
+func (us *UpdaterService) VerifyJetStreamMessage(msg jetstream.Msg) error {
+	if !us.RequireSignedRequests {
+		return nil
+	}
+
+	meta, err := msg.Metadata()
+	if err != nil {
+		return fmt.Errorf("could not get message metadata, reason: %v", err)
+	}
+
+	return us.verifyRequest(msg.Subject(), msg.Headers(), msg.Data(), meta.Timestamp, meta.Sequence.Stream)
+}
+
+// VerifyMessage verifies the signature of a request/reply message
+func (us *UpdaterService) VerifyMessage(msg *nats.Msg) error {
+	if !us.RequireSignedRequests {
+		return nil
+	}
+
+	return us.verifyRequest(msg.Subject, msg.Header, msg.Data, time.Now(), 0)
+}
+
+func (us *UpdaterService) verifyRequest(subject string, header nats.Header, data []byte, received time.Time, sequence uint64) error {
+	if header.Get(SIGNATURE_HEADER) == "" {
+		return errors.New("request is not signed")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(header.Get(SIGNATURE_HEADER))
+	if err != nil {
+		return fmt.Errorf("could not decode signature, reason: %v", err)
+	}
+
+	signer, err := us.verifySigner(header.Get(SIGNER_HEADER))
+	if err != nil {
+		return err
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, header.Get(TIMESTAMP_HEADER))
+	if err != nil {
+		return fmt.Errorf("could not parse timestamp, reason: %v", err)
+	}
+
+	if skew := received.Sub(timestamp).Abs(); skew > us.SignatureMaxSkew {
+		return fmt.Errorf("timestamp %s is %s away from the time the request was received", timestamp.Format(time.RFC3339), skew.Round(time.Second))
+	}
+
+	nonce := header.Get(NONCE_HEADER)
+	if !nonceRegexp.MatchString(nonce) {
+		return errors.New("nonce is missing or invalid")
+	}
+
+	signed := []byte(subject + "\n" + header.Get(TIMESTAMP_HEADER) + "\n" + nonce + "\n")
+	signed = append(signed, data...)
+	if err := verifySignature(signer, signed, signature); err != nil {
+		return err
+	}
+
+	return us.useNonce(nonce, sequence)
+}
+
+// verifySigner parses the base64 DER certificate of the signer and checks
+// that it's issued by the CA and allowed to sign
+func (us *UpdaterService) verifySigner(encoded string) (*x509.Certificate, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode signer certificate, reason: %v", err)
+	}
+
+	signer, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse signer certificate, reason: %v", err)
+	}
+
+	if _, err := signer.Verify(x509.VerifyOptions{Roots: us.signerRoots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		return nil, fmt.Errorf("signer certificate is not trusted, reason: %v", err)
+	}
+
+	if len(us.Signers) > 0 && !slices.Contains(us.Signers, signer.Subject.CommonName) {
+		return nil, fmt.Errorf("%s is not allowed to sign requests", signer.Subject.CommonName)
+	}
+	return signer, nil
+}
+
+// verifySignature checks the signature with the signer's public key, RSA and
+// ECDSA keys sign the SHA-256 digest of the request
+func verifySignature(signer *x509.Certificate, signed []byte, signature []byte) error {
+	digest := sha256.Sum256(signed)
+
+	switch pub := signer.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("signature is not valid")
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest[:], signature) {
+			return errors.New("signature is not valid")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, signed, signature) {
+			return errors.New("signature is not valid")
+		}
+	default:
+		return errors.New("signer key type is not supported")
+	}
+	return nil
+}
+
+// useNonce remembers the nonce so the request is rejected if it's sent again,
+// a message redelivered by JetStream keeps its stream sequence and is accepted
+func (us *UpdaterService) useNonce(nonce string, sequence uint64) error {
+	if us.nonces == nil {
+		return errors.New("nonces can't be checked until NATS is connected")
+	}
+
+	hostname, err := models.GetHostname()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	key := hostname + "." + nonce
+	value := strconv.FormatUint(sequence, 10)
+
+	_, err = us.nonces.Create(ctx, key, []byte(value))
+	if err == nil {
+		return nil
+	}
+
+	if !errors.Is(err, jetstream.ErrKeyExists) {
+		return fmt.Errorf("could not save nonce, reason: %v", err)
+	}
+
+	entry, err := us.nonces.Get(ctx, key)
+	if err == nil && sequence != 0 && string(entry.Value()) == value {
+		return nil
+	}
+	return errors.New("nonce has already been used")
+}
+
+// RejectUpdateMessage terminates an update or control message that couldn't
+// be verified and records the rejection in the update history
+func (us *UpdaterService) RejectUpdateMessage(msg jetstream.Msg, reason error) {
+	log.Printf("[ERROR]: request on %s rejected, reason: %v", msg.Subject(), reason)
+
+	if err := msg.Term(); err != nil {
+		log.Printf("[ERROR]: could not terminate message, reason: %v", err)
+	}
+
+	// The request can't be trusted but it helps to find who sent it
+	data := UpdateRequest{}
+	_ = json.Unmarshal(msg.Data(), &data)
+
+	channel := server.Channel(data.Channel)
+	if server.ChannelValidator(channel) != nil {
+		channel = server.ChannelStable
+	}
+
+	message := fmt.Sprintf("request on %s rejected: %v", msg.Subject(), reason)
+	if us.Model != nil {
+		id, err := us.Model.CreateUpdateHistory(data.Version, channel, data.RequestedBy, data.UpdateAt, models.UpdateHistoryStatusRejected)
+		if err != nil {
+			log.Printf("[ERROR]: could not save update history, reason: %v", err)
+		} else if err := us.Model.FinishUpdateHistory(id, models.UpdateHistoryStatusRejected, message, ""); err != nil {
+			log.Printf("[ERROR]: could not save update history, reason: %v", err)
+		}
+	}
+	us.PublishUpdateEvent(UpdatePhaseRejected, data.Version, channel, message)
+}
+
+// Verified wraps a request/reply handler so it only handles verified requests
+func (us *UpdaterService) Verified(handler nats.MsgHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		if err := us.VerifyMessage(msg); err != nil {
+			log.Printf("[ERROR]: request on %s rejected, reason: %v", msg.Subject, err)
+			us.PublishUpdateEvent(UpdatePhaseRejected, "", server.ChannelStable, fmt.Sprintf("request on %s rejected: %v", msg.Subject, err))
+			us.respond(msg, RejectedResponse{Error: "request rejected: " + err.Error()})
+			return
+		}
+		handler(msg)
+	}
+}
+
+type RejectedResponse struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,292 @@
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// fakeNonces keeps the nonces in memory, only Create and Get are used
+type fakeNonces struct {
+	jetstream.KeyValue
+	values map[string][]byte
+}
+
+type fakeNonceEntry struct {
+	jetstream.KeyValueEntry
+	value []byte
+}
+
+func (e fakeNonceEntry) Value() []byte { return e.value }
+
+func (kv *fakeNonces) Create(ctx context.Context, key string, value []byte, opts ...jetstream.KVCreateOpt) (uint64, error) {
+	if _, ok := kv.values[key]; ok {
+		return 0, jetstream.ErrKeyExists
+	}
+	kv.values[key] = value
+	return uint64(len(kv.values)), nil
+}
+
+func (kv *fakeNonces) Get(ctx context.Context, key string) (jetstream.KeyValueEntry, error) {
+	value, ok := kv.values[key]
+	if !ok {
+		return nil, jetstream.ErrKeyNotFound
+	}
+	return fakeNonceEntry{value: value}, nil
+}
+
+type testSigner struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestCA(t *testing.T, name string) testSigner {
+	t.Helper()
+	return newTestCertificate(t, name, nil)
+}
+
+// newTestCertificate creates a certificate signed by the issuer, or a self
+// signed CA if the issuer is nil
+func newTestCertificate(t *testing.T, name string, issuer *testSigner) testSigner {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	parent, signerKey := template, key
+	if issuer == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signerKey = issuer.cert, issuer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSigner{key: key, cert: cert}
+}
+
+// signedHeader signs the request like the console does
+func signedHeader(t *testing.T, signer testSigner, subject string, timestamp time.Time, nonce string, data []byte) nats.Header {
+	t.Helper()
+
+	ts := timestamp.Format(time.RFC3339)
+	signed := []byte(subject + "\n" + ts + "\n" + nonce + "\n")
+	signed = append(signed, data...)
+	digest := sha256.Sum256(signed)
+
+	signature, err := ecdsa.SignASN1(rand.Reader, signer.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := nats.Header{}
+	header.Set(SIGNATURE_HEADER, base64.StdEncoding.EncodeToString(signature))
+	header.Set(SIGNER_HEADER, base64.StdEncoding.EncodeToString(signer.cert.Raw))
+	header.Set(TIMESTAMP_HEADER, ts)
+	header.Set(NONCE_HEADER, nonce)
+	return header
+}
+
+func newTestSecurityService(ca testSigner, signers ...string) *UpdaterService {
+	us := &UpdaterService{
+		RequireSignedRequests: true,
+		SignatureMaxSkew:      SIGNATURE_DEFAULT_MAX_SKEW,
+		Signers:               signers,
+		signerRoots:           x509.NewCertPool(),
+		nonces:                &fakeNonces{values: map[string][]byte{}},
+	}
+	us.signerRoots.AddCert(ca.cert)
+	return us
+}
+
+func TestVerifyRequest(t *testing.T) {
+	ca := newTestCA(t, "OpenUEM CA")
+	console := newTestCertificate(t, "console", &ca)
+	otherCA := newTestCA(t, "Other CA")
+	other := newTestCertificate(t, "other", &otherCA)
+
+	subject := "server.update.test"
+	data := []byte(`{"version":"0.8.0"}`)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		signers []string
+		header  func() nats.Header
+		wantErr string
+	}{
+		{
+			name:   "valid request",
+			header: func() nats.Header { return signedHeader(t, console, subject, now, "nonce-valid-000001", data) },
+		},
+		{
+			name:    "unsigned request",
+			header:  func() nats.Header { return nats.Header{} },
+			wantErr: "not signed",
+		},
+		{
+			name: "bad signature",
+			header: func() nats.Header {
+				h := signedHeader(t, console, subject, now, "nonce-badsig-00001", data)
+				h.Set(NONCE_HEADER, "nonce-badsig-00002")
+				return h
+			},
+			wantErr: "signature is not valid",
+		},
+		{
+			name:    "signer certificate issued by another CA",
+			header:  func() nats.Header { return signedHeader(t, other, subject, now, "nonce-other-000001", data) },
+			wantErr: "not trusted",
+		},
+		{
+			name:    "signer not allowed",
+			signers: []string{"admin"},
+			header:  func() nats.Header { return signedHeader(t, console, subject, now, "nonce-allowed-0001", data) },
+			wantErr: "not allowed",
+		},
+		{
+			name: "timestamp too old",
+			header: func() nats.Header {
+				return signedHeader(t, console, subject, now.Add(-SIGNATURE_DEFAULT_MAX_SKEW-time.Minute), "nonce-old-00000001", data)
+			},
+			wantErr: "away from the time",
+		},
+		{
+			name: "timestamp in the future",
+			header: func() nats.Header {
+				return signedHeader(t, console, subject, now.Add(SIGNATURE_DEFAULT_MAX_SKEW+time.Minute), "nonce-future-00001", data)
+			},
+			wantErr: "away from the time",
+		},
+		{
+			name:    "invalid nonce",
+			header:  func() nats.Header { return signedHeader(t, console, subject, now, "short", data) },
+			wantErr: "nonce is missing or invalid",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us := newTestSecurityService(ca, tt.signers...)
+			err := us.verifyRequest(subject, tt.header(), data, now, 1)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("verifyRequest() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verifyRequest() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyRequestReplay(t *testing.T) {
+	ca := newTestCA(t, "OpenUEM CA")
+	console := newTestCertificate(t, "console", &ca)
+	us := newTestSecurityService(ca)
+
+	subject := "server.update.test"
+	data := []byte(`{"version":"0.8.0"}`)
+	now := time.Now()
+	header := signedHeader(t, console, subject, now, "nonce-replay-00001", data)
+
+	if err := us.verifyRequest(subject, header, data, now, 7); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := us.verifyRequest(subject, header, data, now, 7); err != nil {
+		t.Errorf("redelivered request: %v", err)
+	}
+	if err := us.verifyRequest(subject, header, data, now, 8); err == nil {
+		t.Error("replayed request was accepted")
+	}
+}
+
+func TestUseNonce(t *testing.T) {
+	tests := []struct {
+		name    string
+		first   uint64
+		second  uint64
+		wantErr bool
+	}{
+		{name: "redelivery of the same stream sequence", first: 3, second: 3},
+		{name: "replay with another stream sequence", first: 3, second: 4, wantErr: true},
+		{name: "replay of a request/reply message", first: 0, second: 0, wantErr: true},
+		{name: "replay of a request/reply message as a stream message", first: 0, second: 3, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us := &UpdaterService{nonces: &fakeNonces{values: map[string][]byte{}}}
+			if err := us.useNonce("nonce-0123456789ab", tt.first); err != nil {
+				t.Fatalf("useNonce() first use error = %v", err)
+			}
+			err := us.useNonce("nonce-0123456789ab", tt.second)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("useNonce() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifySigner(t *testing.T) {
+	ca := newTestCA(t, "OpenUEM CA")
+	console := newTestCertificate(t, "console", &ca)
+	otherCA := newTestCA(t, "Other CA")
+	other := newTestCertificate(t, "console", &otherCA)
+
+	tests := []struct {
+		name    string
+		signers []string
+		encoded string
+		wantErr bool
+	}{
+		{name: "issued by the CA", encoded: base64.StdEncoding.EncodeToString(console.cert.Raw)},
+		{name: "allowed signer", signers: []string{"admin", "console"}, encoded: base64.StdEncoding.EncodeToString(console.cert.Raw)},
+		{name: "signer not allowed", signers: []string{"admin"}, encoded: base64.StdEncoding.EncodeToString(console.cert.Raw), wantErr: true},
+		{name: "issued by another CA", encoded: base64.StdEncoding.EncodeToString(other.cert.Raw), wantErr: true},
+		{name: "not base64", encoded: "not base64!", wantErr: true},
+		{name: "not a certificate", encoded: base64.StdEncoding.EncodeToString([]byte("certificate")), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us := newTestSecurityService(ca, tt.signers...)
+			_, err := us.verifySigner(tt.encoded)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifySigner() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
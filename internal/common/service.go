@@ -6,14 +6,13 @@ import (
 	"fmt"
 	"log"
 	"math"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/go-co-op/gocron/v2"
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/open-uem/ent/server"
-	openuem_nats "github.com/open-uem/nats"
+	"github.com/open-uem/openuem-server-updater/internal/models"
 )
 
 func (us *UpdaterService) StartService() {
@@ -30,6 +29,11 @@ func (us *UpdaterService) StartService() {
 	if err := us.StartNATSConnectJob(us.queueSubscribe); err != nil {
 		return
 	}
+
+	// Start the job that looks for new versions
+	if err := us.StartAvailabilityCheckJob(); err != nil {
+		return
+	}
 }
 
 func (us *UpdaterService) StopService() {
@@ -48,15 +52,11 @@ func (us *UpdaterService) StopService() {
 func (us *UpdaterService) queueSubscribe() error {
 	var ctx context.Context
 
-	hostname, err := os.Hostname()
+	hostname, err := models.GetHostname()
 	if err != nil {
 		return err
 	}
 
-	// Issue #2 prevent hostname to include domain accidentally
-	hostnameParts := strings.Split(hostname, ".")
-	hostname = hostnameParts[0]
-
 	js, err := jetstream.New(us.NATSConnection)
 	if err != nil {
 		log.Printf("[ERROR]: could not instantiate JetStream: %s", err.Error())
@@ -84,11 +84,27 @@ func (us *UpdaterService) queueSubscribe() error {
 		return err
 	}
 
+	if err := us.CreateEventsStream(ctx, js, len(replicas)); err != nil {
+		log.Printf("[ERROR]: could not instantiate %s, reason: %v\n", EVENTS_STREAM, err)
+		return err
+	}
+	us.SetJetStream(js)
+
+	if err := us.CreateUpdateLocks(ctx, js, len(replicas)); err != nil {
+		log.Printf("[ERROR]: could not instantiate %s, reason: %v\n", UPDATE_LOCKS_BUCKET, err)
+		return err
+	}
+
+	if err := us.CreateNonceStore(ctx, js, len(replicas)); err != nil {
+		log.Printf("[ERROR]: could not instantiate %s, reason: %v\n", NONCES_BUCKET, err)
+		return err
+	}
+
 	consumerConfig := jetstream.ConsumerConfig{
 		Durable:        "ServerUpdater" + hostname,
 		AckWait:        10 * time.Minute,
 		AckPolicy:      jetstream.AckExplicitPolicy,
-		FilterSubjects: []string{"server.update." + hostname},
+		FilterSubjects: []string{"server.update." + hostname, "server.update." + hostname + ".cancel", "server.update." + hostname + ".reschedule"},
 	}
 
 	if len(strings.Split(us.NATSServers, ",")) > 1 {
@@ -107,32 +123,120 @@ func (us *UpdaterService) queueSubscribe() error {
 
 	log.Println("[INFO]: Jetstream created and started consuming messages")
 
+	// Publish the events that happened while we were not connected
+	us.FlushUpdateEvents()
+
+	if _, err := us.NATSConnection.Subscribe("server.updater."+hostname+".restore", us.Verified(us.RestoreHandler)); err != nil {
+		log.Printf("[ERROR]: could not subscribe to restore requests, reason: %v", err)
+		return err
+	}
+
+	if _, err := us.NATSConnection.Subscribe("server.updater."+hostname+".log", us.Verified(us.UpdateLogHandler)); err != nil {
+		log.Printf("[ERROR]: could not subscribe to update log requests, reason: %v", err)
+		return err
+	}
+
+	if _, err := us.NATSConnection.Subscribe("server.updater."+hostname+".dryrun", us.Verified(us.DryRunHandler)); err != nil {
+		log.Printf("[ERROR]: could not subscribe to dry run requests, reason: %v", err)
+		return err
+	}
+
+	if _, err := us.NATSConnection.Subscribe("server.updater."+hostname+".pending", us.Verified(us.PendingUpdatesHandler)); err != nil {
+		log.Printf("[ERROR]: could not subscribe to pending updates requests, reason: %v", err)
+		return err
+	}
+
+	if _, err := us.NATSConnection.Subscribe("server.updater."+hostname+".channel", us.Verified(us.ChannelSwitchHandler)); err != nil {
+		log.Printf("[ERROR]: could not subscribe to channel switch requests, reason: %v", err)
+		return err
+	}
+
+	if _, err := us.NATSConnection.Subscribe("server.updater."+hostname+".lease", us.Verified(us.LeaseReleaseHandler)); err != nil {
+		log.Printf("[ERROR]: could not subscribe to update slot requests, reason: %v", err)
+		return err
+	}
+
 	return nil
 }
 
 func (us *UpdaterService) JetStreamUpdaterHandler(msg jetstream.Msg) {
-	var channel server.Channel
-	data := openuem_nats.OpenUEMUpdateRequest{}
+	data := UpdateRequest{}
+
+	// Only signed requests are accepted
+	if err := us.VerifyJetStreamMessage(msg); err != nil {
+		us.RejectUpdateMessage(msg, err)
+		return
+	}
+
+	// Control messages for pending updates
+	for _, operation := range []string{"cancel", "reschedule"} {
+		if strings.HasSuffix(msg.Subject(), "."+operation) {
+			us.UpdateControlHandler(msg, operation)
+			return
+		}
+	}
 
 	if err := json.Unmarshal(msg.Data(), &data); err != nil {
-		log.Printf("[ERROR]: could not unmarshal update request, reason: %v\n", err)
+		us.RejectInvalidRequest(msg, data, fmt.Errorf("could not unmarshal update request, reason: %v", err))
+		return
+	}
+
+	if err := us.ResolveReleaseManifest(&data); err != nil {
+		us.RejectInvalidRequest(msg, data, err)
+		return
+	}
+
+	channel, err := us.ValidateUpdateRequest(data)
+	if err != nil {
+		us.RejectInvalidRequest(msg, data, err)
+		return
+	}
 
+	us.PublishUpdateEvent(UpdatePhaseReceived, data.Version, channel, "")
+
+	// Dry runs only report what would be installed
+	if data.DryRun {
 		if err := msg.Ack(); err != nil {
 			log.Printf("[ERROR]: could not ACK message, reason: %v", err)
-			return
 		}
+		us.ReportDryRun(data, channel)
 		return
 	}
 
-	switch data.Channel {
-	case "stable":
-		channel = server.ChannelStable
-	case "devel":
-		channel = server.ChannelDevel
-	case "testing":
-		channel = server.ChannelTesting
-	default:
-		channel = server.ChannelStable
+	// Downgrades, skipped major versions and pre-releases need an override
+	if !us.ApplyVersionPolicy(data, msg, channel) {
+		return
+	}
+
+	// Updates can only run inside the maintenance windows
+	if us.Maintenance != nil && (data.UpdateNow || !data.UpdateAt.IsZero()) {
+		requested := time.Now()
+		if !data.UpdateNow && data.UpdateAt.After(requested) {
+			requested = data.UpdateAt
+		}
+
+		slot, err := us.Maintenance.NextSlot(requested)
+		if err != nil || data.RejectOutsideWindow && !slot.Equal(requested) {
+			reason := fmt.Sprintf("update requested for %s is outside the maintenance windows", requested.Format(time.RFC3339))
+			if err != nil {
+				reason = err.Error()
+			}
+			log.Printf("[ERROR]: update rejected, %s", reason)
+
+			if err := msg.Ack(); err != nil {
+				log.Printf("[ERROR]: could not ACK message, reason: %v", err)
+			}
+			historyID := us.StartUpdateHistory(data, channel)
+			us.SetUpdateStatus(historyID, data.Version, channel, server.UpdateStatusError, "update rejected, "+reason, time.Now())
+			return
+		}
+
+		if !slot.Equal(requested) {
+			log.Printf("[INFO]: update deferred to the next maintenance window at %s", slot.String())
+			data.UpdateNow = false
+			data.UpdateAt = slot
+			us.SetUpdateStatus(0, us.Version, channel, server.UpdateStatusPending, "update deferred to the next maintenance window at "+slot.Format(time.RFC3339), slot)
+		}
 	}
 
 	// If scheduled time is in the past execute now
@@ -159,35 +263,33 @@ func (us *UpdaterService) JetStreamUpdaterHandler(msg jetstream.Msg) {
 				log.Printf("[ERROR]: could not ACK message, reason: %v", err)
 			}
 
-			if err := us.Model.UpdateServerStatus(data.Version, channel, server.UpdateStatusError, fmt.Sprintf("could not schedule the update task: %v", err), time.Now()); err != nil {
-				log.Printf("[ERROR]: could not save update server status: %v\n", err)
-			}
+			historyID := us.StartUpdateHistory(data, channel)
+			us.SetUpdateStatus(historyID, data.Version, channel, server.UpdateStatusError, fmt.Sprintf("could not schedule the update task: %v", err), time.Now())
 			return
 		}
 		log.Println("[INFO]: new update task will run now")
 	} else {
 		if !time.Time.IsZero(data.UpdateAt) {
-			_, err := us.TaskScheduler.NewJob(
-				gocron.OneTimeJob(gocron.OneTimeJobStartDateTime(data.UpdateAt)),
-				gocron.NewTask(func() {
-					us.ExecuteUpdate(data, msg, data.Version, channel)
-				}),
-			)
+			var sequence uint64
+			if meta, err := msg.Metadata(); err == nil {
+				sequence = meta.Sequence.Stream
+			}
 
-			if err != nil {
+			// The request is delivered again if it can't be stored
+			if err := us.SchedulePendingUpdate(data, channel, sequence); err != nil {
 				log.Printf("[ERROR]: could not schedule the update task: %v\n", err)
 
-				if err := msg.Ack(); err != nil {
-					log.Printf("[ERROR]: could not ACK message, reason: %v", err)
-					return
-				}
-
-				if err := us.Model.UpdateServerStatus(data.Version, channel, server.UpdateStatusError, fmt.Sprintf("could not schedule the update task: %v", err), time.Now()); err != nil {
-					log.Printf("[ERROR]: could not save update server status: %v\n", err)
+				if err := msg.NakWithDelay(time.Minute); err != nil {
+					log.Printf("[ERROR]: could not NAK message, reason: %v", err)
 				}
 				return
 			}
+
+			if err := msg.Ack(); err != nil {
+				log.Printf("[ERROR]: could not ACK message, reason: %v", err)
+			}
 			log.Printf("[INFO]: new update task scheduled a %s", data.UpdateAt.String())
+			us.PublishUpdateEvent(UpdatePhaseScheduled, data.Version, channel, "update scheduled at "+data.UpdateAt.String())
 		}
 	}
 }
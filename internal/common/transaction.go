@@ -0,0 +1,96 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/open-uem/ent/server"
+)
+
+// Transaction is what a package manager would do to install an update
+type Transaction struct {
+	Packages     []PackageChange `json:"packages"`
+	DownloadSize string          `json:"download_size,omitempty"`
+	Conflicts    []string        `json:"conflicts,omitempty"`
+}
+
+type PackageChange struct {
+	Name string `json:"name"`
+	From string `json:"from,omitempty"`
+	To   string `json:"to"`
+}
+
+// DryRunReport is sent back for update requests with the dry run flag
+type DryRunReport struct {
+	Version        string       `json:"version"`
+	Channel        string       `json:"channel"`
+	PackageManager string       `json:"package_manager,omitempty"`
+	Transaction    *Transaction `json:"transaction,omitempty"`
+	Error          string       `json:"error,omitempty"`
+}
+
+func (r *DryRunReport) String() string {
+	if r.Error != "" {
+		return fmt.Sprintf("dry run of %s failed: %s", r.Version, r.Error)
+	}
+
+	changes := []string{}
+	for _, p := range r.Transaction.Packages {
+		if p.From != "" {
+			changes = append(changes, fmt.Sprintf("%s %s -> %s", p.Name, p.From, p.To))
+		} else {
+			changes = append(changes, fmt.Sprintf("%s %s", p.Name, p.To))
+		}
+	}
+
+	report := fmt.Sprintf("dry run of %s: %s", r.Version, strings.Join(changes, ", "))
+	if r.Transaction.DownloadSize != "" {
+		report += fmt.Sprintf("; download size %s", r.Transaction.DownloadSize)
+	}
+	if len(r.Transaction.Conflicts) > 0 {
+		report += fmt.Sprintf("; conflicts: %s", strings.Join(r.Transaction.Conflicts, ", "))
+	}
+	return report
+}
+
+// ReportDryRun runs a dry run and saves the report in the update message of
+// the server row without changing the update status
+func (us *UpdaterService) ReportDryRun(data UpdateRequest, channel server.Channel) {
+	report := us.DryRun(data)
+
+	if err := us.Model.SetServerUpdateMessage(report.String()); err != nil {
+		log.Printf("[ERROR]: could not save dry run report, reason: %v", err)
+	}
+
+	details, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("[ERROR]: could not marshal dry run report, reason: %v", err)
+		return
+	}
+	us.PublishUpdateEvent(UpdatePhaseDryRun, data.Version, channel, string(details))
+}
+
+// DryRunHandler sends back a dry run report with NATS request/reply
+func (us *UpdaterService) DryRunHandler(msg *nats.Msg) {
+	data := UpdateRequest{}
+
+	if err := json.Unmarshal(msg.Data, &data); err != nil {
+		us.respond(msg, DryRunReport{Error: fmt.Sprintf("could not unmarshal update request, reason: %v", err)})
+		return
+	}
+
+	if err := us.ResolveReleaseManifest(&data); err != nil {
+		us.respond(msg, DryRunReport{Version: data.Version, Channel: data.Channel, Error: "invalid release manifest: " + err.Error()})
+		return
+	}
+
+	if _, err := us.ValidateUpdateRequest(data); err != nil {
+		us.respond(msg, DryRunReport{Version: data.Version, Channel: data.Channel, Error: "invalid update request: " + err.Error()})
+		return
+	}
+
+	us.respond(msg, us.DryRun(data))
+}
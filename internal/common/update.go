@@ -0,0 +1,226 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/open-uem/ent/server"
+	"github.com/open-uem/openuem-server-updater/internal/models"
+)
+
+// UpdateState is saved before the package manager takes over, so the updater
+// knows what was installed before the update once it has been restarted
+type UpdateState struct {
+	HistoryID        int64             `json:"history_id"`
+	Version          string            `json:"version"`
+	Channel          server.Channel    `json:"channel"`
+	StartedAt        time.Time         `json:"started_at"`
+	PreviousVersion  string            `json:"previous_version"`
+	PreviousPackages []Package         `json:"previous_packages"`
+	Packages         []Package         `json:"packages"`
+	PackageManager   string            `json:"package_manager,omitempty"`
+	LogFile          string            `json:"log_file,omitempty"`
+	RunnerUnit       string            `json:"runner_unit,omitempty"`
+	RolledBack       bool              `json:"rolled_back"`
+	Reason           string            `json:"reason,omitempty"`
+	Components       []string          `json:"components,omitempty"`
+	HealthEndpoints  map[string]string `json:"health_endpoints,omitempty"`
+	StepTimeout      time.Duration     `json:"step_timeout,omitempty"`
+	AllowDowngrade   bool              `json:"allow_downgrade,omitempty"`
+	MigrationLevels  map[string]int    `json:"migration_levels,omitempty"`
+}
+
+func SaveUpdateState(state *UpdateState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(UpdateStateFile()), 0700); err != nil {
+		return err
+	}
+
+	return os.WriteFile(UpdateStateFile(), data, 0600)
+}
+
+// LoadUpdateState returns the saved update state or nil if there's no update to evaluate
+func LoadUpdateState() (*UpdateState, error) {
+	data, err := os.ReadFile(UpdateStateFile())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	state := UpdateState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func RemoveUpdateState() {
+	if err := os.Remove(UpdateStateFile()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("[ERROR]: could not remove update state, reason: %v", err)
+	}
+	RemoveRunnerState()
+}
+
+// EvaluatePreviousUpdate checks if an update in progress has installed the
+// requested version and every component is healthy, if it didn't the previous
+// versions are reinstalled
+func (us *UpdaterService) EvaluatePreviousUpdate() {
+	s, err := us.Model.GetServerStatus()
+	if err != nil {
+		log.Println("[ERROR]: could not get server status")
+		return
+	}
+
+	if s.UpdateStatus != server.UpdateStatusInProgress {
+		return
+	}
+
+	state, err := LoadUpdateState()
+	if err != nil {
+		log.Printf("[ERROR]: could not read update state, reason: %v", err)
+	}
+
+	// Wait for the package manager if it's still running and use its exit
+	// status as the reason if the update didn't complete
+	reason := "installation didn't complete"
+	runnerFailure := ""
+	historyID := int64(0)
+	output := ""
+	if state != nil {
+		rs, err := WaitForRunner(state)
+		if err != nil {
+			log.Printf("[ERROR]: %v", err)
+			runnerFailure = err.Error()
+		} else if rs != nil && rs.ExitCode != 0 {
+			runnerFailure = fmt.Sprintf("package manager exited with code %d: %s", rs.ExitCode, rs.Error)
+		}
+		if runnerFailure != "" {
+			reason = runnerFailure
+		}
+
+		historyID = state.HistoryID
+		output = ReadUpdateOutput(historyID)
+	}
+
+	// We were rolling back a failed update. The server row has no rolled back
+	// status so the message is prefixed to tell it apart from a failed update
+	if state != nil && state.RolledBack {
+		message := fmt.Sprintf("%s%s restored after the update to %s failed: %s", UPDATE_ROLLED_BACK_PREFIX, state.PreviousVersion, state.Version, state.Reason)
+		phase := UpdatePhaseRolledBack
+		if us.Version != state.PreviousVersion {
+			message = fmt.Sprintf("%s%s wasn't restored after the update to %s failed: %s", UPDATE_ROLLBACK_FAILED_PREFIX, state.PreviousVersion, state.Version, state.Reason)
+			phase = UpdatePhaseFailed
+		}
+		if err := us.Model.UpdateServerStatus(us.Version, server.UpdateStatusError, WithOutputTail(message, output), s.UpdateWhen); err != nil {
+			log.Printf("[ERROR]: could not save server status, reason: %v\n", err)
+		}
+		if err := us.Model.FinishUpdateHistory(state.HistoryID, models.UpdateHistoryStatusRolledBack, message, output); err != nil {
+			log.Printf("[ERROR]: could not save update history, reason: %v\n", err)
+		}
+		us.PublishUpdateEvent(phase, state.Version, s.Channel, message)
+		RemoveUpdateState()
+		return
+	}
+
+	if s.Version == us.Version {
+		us.PublishUpdateEvent(UpdatePhaseVerification, s.Version, s.Channel, "")
+		packages := []Package{}
+		if state != nil {
+			packages = state.Packages
+		}
+		checks, passed := us.VerifyComponents(s.Version, packages)
+		if passed {
+			us.SetUpdateStatusWithOutput(historyID, s.Version, s.Channel, server.UpdateStatusSuccess, SummarizeChecks(checks), output, s.UpdateWhen)
+			if state != nil {
+				us.SaveMigrationLevels(state)
+			}
+			RemoveUpdateState()
+
+			// The next server of a rolling update can start now
+			us.ReleaseUpdateLease()
+			return
+		}
+		reason = "verification failed: " + SummarizeChecks(checks)
+		if runnerFailure != "" {
+			reason = runnerFailure + ", " + reason
+		}
+	}
+	if state == nil || len(state.PreviousPackages) == 0 {
+		us.SetUpdateStatusWithOutput(historyID, s.Version, s.Channel, server.UpdateStatusError, reason, output, s.UpdateWhen)
+		RemoveUpdateState()
+		return
+	}
+
+	log.Printf("[INFO]: update to %s failed, rolling back to %s", state.Version, state.PreviousVersion)
+	if err := us.Rollback(state, reason); err != nil {
+		log.Printf("[ERROR]: could not roll back, reason: %v", err)
+		us.SetUpdateStatusWithOutput(historyID, s.Version, s.Channel, server.UpdateStatusError, fmt.Sprintf("%s and rollback to %s failed: %v", reason, state.PreviousVersion, err), output, s.UpdateWhen)
+		RemoveUpdateState()
+		return
+	}
+
+	if err := us.Model.UpdateServerStatus(state.PreviousVersion, server.UpdateStatusInProgress, WithOutputTail(fmt.Sprintf("rolling back to %s, reason: %s", state.PreviousVersion, reason), output), time.Now()); err != nil {
+		log.Printf("[ERROR]: could not save server status, reason: %v\n", err)
+	}
+	us.PublishUpdateEvent(UpdatePhasePackageManager, state.Version, s.Channel, fmt.Sprintf("rolling back to %s, reason: %s", state.PreviousVersion, reason))
+}
+
+// StartUpdateHistory adds the update attempt to the update history
+func (us *UpdaterService) StartUpdateHistory(data UpdateRequest, channel server.Channel) int64 {
+	id, err := us.Model.CreateUpdateHistory(data.Version, channel, data.RequestedBy, data.UpdateAt, string(server.UpdateStatusInProgress))
+	if err != nil {
+		log.Printf("[ERROR]: could not save update history, reason: %v", err)
+	}
+	return id
+}
+
+// SetUpdateStatus saves the update status in the server row and, if the
+// status is final, ends the update attempt in the update history and
+// publishes the outcome. Pending statuses are saved with the installed
+// version, the version to install is kept in the pending update
+func (us *UpdaterService) SetUpdateStatus(historyID int64, version string, channel server.Channel, status server.UpdateStatus, message string, when time.Time) {
+	us.SetUpdateStatusWithOutput(historyID, version, channel, status, message, "", when)
+}
+
+// SetUpdateStatusWithOutput works like SetUpdateStatus and stores the package
+// manager's output in the update history and its tail in the update message
+// if the update failed
+func (us *UpdaterService) SetUpdateStatusWithOutput(historyID int64, version string, channel server.Channel, status server.UpdateStatus, message string, output string, when time.Time) {
+	serverMessage := message
+	if status == server.UpdateStatusError {
+		serverMessage = WithOutputTail(message, output)
+	}
+
+	if err := us.Model.UpdateServerStatus(version, status, serverMessage, when); err != nil {
+		log.Printf("[ERROR]: could not save server status, reason: %v", err)
+	}
+
+	if status == server.UpdateStatusInProgress || status == server.UpdateStatusPending {
+		return
+	}
+
+	if status == server.UpdateStatusSuccess {
+		us.PublishUpdateEvent(UpdatePhaseFinished, version, channel, message)
+	} else {
+		us.PublishUpdateEvent(UpdatePhaseFailed, version, channel, message)
+	}
+
+	if historyID == 0 {
+		return
+	}
+
+	if err := us.Model.FinishUpdateHistory(historyID, string(status), message, output); err != nil {
+		log.Printf("[ERROR]: could not save update history, reason: %v", err)
+	}
+}
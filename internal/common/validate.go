@@ -0,0 +1,215 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/open-uem/ent/server"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	VALIDATION_DEFAULT_MAX_REQUEST_AGE    = 24 * time.Hour
+	VALIDATION_DEFAULT_MAX_SCHEDULE_AHEAD = 180 * 24 * time.Hour
+	VALIDATION_DEFAULT_DOWNLOAD_HOSTS     = "github.com,objects.githubusercontent.com"
+	VERSION_MAX_LENGTH                    = 64
+)
+
+// Versions are semantic versions, the package managers receive them as
+// arguments so anything else is rejected before reaching them
+var (
+	strictVersionRegexp = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(-[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?(\+[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?$`)
+	downloadHashRegexp  = regexp.MustCompile(`^[0-9A-Fa-f]{64}$`)
+)
+
+// ReadValidationConfig reads the optional [Validation] section. DownloadHosts
+// is the list of hosts the Windows installer can be downloaded from, an entry
+// starting with *. allows the subdomains of a domain
+func (us *UpdaterService) ReadValidationConfig(cfg *ini.File) {
+	section := cfg.Section("Validation")
+
+	us.DownloadHosts = splitList(section.Key("DownloadHosts").MustString(VALIDATION_DEFAULT_DOWNLOAD_HOSTS))
+	us.MaxRequestAge = section.Key("MaxRequestAge").MustDuration(VALIDATION_DEFAULT_MAX_REQUEST_AGE)
+	us.MaxScheduleAhead = section.Key("MaxScheduleAhead").MustDuration(VALIDATION_DEFAULT_MAX_SCHEDULE_AHEAD)
+}
+
+// ValidateUpdateRequest checks every field of the request and returns its channel
+func (us *UpdaterService) ValidateUpdateRequest(data UpdateRequest) (server.Channel, error) {
+	if err := ValidateVersion(data.Version); err != nil {
+		return "", err
+	}
+
+	channel, err := ValidateChannel(data.Channel)
+	if err != nil {
+		return "", err
+	}
+
+	if data.DownloadFrom != "" || runtime.GOOS == "windows" {
+		if err := us.ValidateDownload(data.DownloadFrom, data.DownloadHash); err != nil {
+			return "", err
+		}
+	}
+
+	// A request without time would never run, dry runs only report
+	if data.UpdateNow && !data.UpdateAt.IsZero() {
+		return "", errors.New("update_now and update_at can't be used together")
+	}
+	if !data.UpdateNow && data.UpdateAt.IsZero() && !data.DryRun {
+		return "", errors.New("update_now or update_at is required")
+	}
+
+	if !data.UpdateAt.IsZero() {
+		if err := us.ValidateUpdateAt(data.UpdateAt); err != nil {
+			return "", err
+		}
+	}
+
+	if data.Manifest != nil {
+		m := ReleaseManifest{}
+		if err := json.Unmarshal(data.Manifest.Manifest, &m); err != nil {
+			return "", fmt.Errorf("could not unmarshal release manifest, reason: %v", err)
+		}
+		if err := us.ValidateReleaseManifest(&m); err != nil {
+			return "", err
+		}
+	}
+
+	return channel, nil
+}
+
+// The packages that are not a component: the Debian meta package, the
+// updater and the cert manager tool
+var otherOpenUEMPackages = []string{"openuem-server", "openuem-server-updater", "openuem-cert-manager"}
+
+// ValidatePackageName checks that the package is an OpenUEM package
+func ValidatePackageName(name string) error {
+	if slices.Contains(otherOpenUEMPackages, name) {
+		return nil
+	}
+
+	for _, c := range openUEMComponents {
+		if c.Package == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not a known OpenUEM component", name)
+}
+
+func ValidateVersion(version string) error {
+	if len(version) > VERSION_MAX_LENGTH {
+		return fmt.Errorf("version is longer than %d characters", VERSION_MAX_LENGTH)
+	}
+
+	if !strictVersionRegexp.MatchString(version) {
+		return fmt.Errorf("version %q is not a valid version", version)
+	}
+	return nil
+}
+
+// ValidateChannel returns the channel of the request, requests without
+// channel are for the stable channel
+func ValidateChannel(channel string) (server.Channel, error) {
+	if channel == "" {
+		return server.ChannelStable, nil
+	}
+
+	if err := server.ChannelValidator(server.Channel(channel)); err != nil {
+		return "", fmt.Errorf("channel %q is not a known channel", channel)
+	}
+	return server.Channel(channel), nil
+}
+
+// ValidateDownload checks that the installer is downloaded with https from
+// an allowed host and that its SHA-256 hash is provided
+func (us *UpdaterService) ValidateDownload(downloadFrom string, downloadHash string) error {
+	if err := us.ValidateDownloadURL(downloadFrom); err != nil {
+		return err
+	}
+
+	if !downloadHashRegexp.MatchString(downloadHash) {
+		return errors.New("download hash must be a SHA-256 hash in hex")
+	}
+	return nil
+}
+
+// ValidateDownloadURL checks that the url uses https and an allowed host
+func (us *UpdaterService) ValidateDownloadURL(downloadFrom string) error {
+	u, err := url.Parse(downloadFrom)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("download url %q is not valid", downloadFrom)
+	}
+
+	if u.Scheme != "https" {
+		return fmt.Errorf("download url %q must use https", downloadFrom)
+	}
+
+	if u.User != nil {
+		return fmt.Errorf("download url %q must not have credentials", downloadFrom)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	allowed := slices.ContainsFunc(us.DownloadHosts, func(h string) bool {
+		h = strings.ToLower(h)
+		if domain, ok := strings.CutPrefix(h, "*."); ok {
+			return strings.HasSuffix(host, "."+domain)
+		}
+		return host == h
+	})
+	if !allowed {
+		return fmt.Errorf("download host %s is not allowed", host)
+	}
+	return nil
+}
+
+// ValidateUpdateAt rejects updates scheduled too far in the future and
+// stale requests whose time passed long ago
+func (us *UpdaterService) ValidateUpdateAt(updateAt time.Time) error {
+	now := time.Now()
+
+	if updateAt.Before(now.Add(-us.MaxRequestAge)) {
+		return fmt.Errorf("update time %s is older than %s", updateAt.Format(time.RFC3339), us.MaxRequestAge)
+	}
+
+	if updateAt.After(now.Add(us.MaxScheduleAhead)) {
+		return fmt.Errorf("update time %s is more than %s away", updateAt.Format(time.RFC3339), us.MaxScheduleAhead)
+	}
+	return nil
+}
+
+// RejectInvalidRequest terminates an update request that failed validation
+// and records why. The server keeps its version as the requested version
+// can't be trusted
+func (us *UpdaterService) RejectInvalidRequest(msg jetstream.Msg, data UpdateRequest, reason error) {
+	log.Printf("[ERROR]: invalid update request, reason: %v", reason)
+
+	if err := msg.Term(); err != nil {
+		log.Printf("[ERROR]: could not terminate message, reason: %v", err)
+	}
+
+	channel, err := ValidateChannel(data.Channel)
+	if err != nil {
+		channel = server.ChannelStable
+	}
+
+	if len(data.Version) > VERSION_MAX_LENGTH {
+		data.Version = data.Version[:VERSION_MAX_LENGTH]
+	}
+
+	message := "invalid update request: " + reason.Error()
+	if us.Model == nil {
+		us.PublishUpdateEvent(UpdatePhaseFailed, data.Version, channel, message)
+		return
+	}
+
+	historyID := us.StartUpdateHistory(data, channel)
+	us.SetUpdateStatus(historyID, us.Version, channel, server.UpdateStatusError, message, time.Now())
+}
@@ -0,0 +1,101 @@
+package common
+
+import (
+	"encoding/json"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateUpdateRequest(t *testing.T) {
+	us := &UpdaterService{
+		DownloadHosts:    []string{"github.com"},
+		MaxRequestAge:    VALIDATION_DEFAULT_MAX_REQUEST_AGE,
+		MaxScheduleAhead: VALIDATION_DEFAULT_MAX_SCHEDULE_AHEAD,
+	}
+
+	manifest := func(packageName string) *SignedManifest {
+		m, err := json.Marshal(ReleaseManifest{
+			Version: "0.8.0",
+			Components: []ManifestComponent{
+				{Name: "console", Version: "0.8.0", Packages: map[string]string{"redhat": packageName}},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &SignedManifest{Manifest: m}
+	}
+
+	tests := []struct {
+		name    string
+		request func(data *UpdateRequest)
+		wantErr string
+	}{
+		{name: "update now", request: func(data *UpdateRequest) {}},
+		{name: "scheduled update", request: func(data *UpdateRequest) {
+			data.UpdateNow = false
+			data.UpdateAt = time.Now().Add(time.Hour)
+		}},
+		{name: "stable channel by default", request: func(data *UpdateRequest) { data.Channel = "" }},
+		{name: "dry run without time", request: func(data *UpdateRequest) {
+			data.UpdateNow = false
+			data.DryRun = true
+		}},
+		{name: "known component", request: func(data *UpdateRequest) { data.Manifest = manifest("openuem-console") }},
+		{name: "updater package", request: func(data *UpdateRequest) { data.Manifest = manifest("openuem-server-updater") }},
+		{name: "version with shell characters", request: func(data *UpdateRequest) { data.Version = "0.8.0;reboot" }, wantErr: "not a valid version"},
+		{name: "version without patch", request: func(data *UpdateRequest) { data.Version = "0.8" }, wantErr: "not a valid version"},
+		{name: "version too long", request: func(data *UpdateRequest) { data.Version = "0.8.0-" + strings.Repeat("a", VERSION_MAX_LENGTH) }, wantErr: "longer than"},
+		{name: "unknown channel", request: func(data *UpdateRequest) { data.Channel = "nightly" }, wantErr: "not a known channel"},
+		{name: "unknown component", request: func(data *UpdateRequest) { data.Manifest = manifest("openuem-unknown") }, wantErr: "not a known OpenUEM component"},
+		{name: "update now and update at", request: func(data *UpdateRequest) {
+			data.UpdateAt = time.Now().Add(time.Hour)
+		}, wantErr: "can't be used together"},
+		{name: "neither update now nor update at", request: func(data *UpdateRequest) { data.UpdateNow = false }, wantErr: "is required"},
+		{name: "update at too far", request: func(data *UpdateRequest) {
+			data.UpdateNow = false
+			data.UpdateAt = time.Now().Add(VALIDATION_DEFAULT_MAX_SCHEDULE_AHEAD + time.Hour)
+		}, wantErr: "away"},
+		{name: "stale update at", request: func(data *UpdateRequest) {
+			data.UpdateNow = false
+			data.UpdateAt = time.Now().Add(-VALIDATION_DEFAULT_MAX_REQUEST_AGE - time.Hour)
+		}, wantErr: "older than"},
+		{name: "download over http", request: func(data *UpdateRequest) {
+			data.DownloadFrom = "http://github.com/open-uem/openuem-server/releases/download/v0.8.0/openuem-server.exe"
+		}, wantErr: "must use https"},
+		{name: "download from a host not allowed", request: func(data *UpdateRequest) {
+			data.DownloadFrom = "https://example.com/openuem-server.exe"
+		}, wantErr: "not allowed"},
+		{name: "download without hash", request: func(data *UpdateRequest) {
+			data.DownloadFrom = "https://github.com/open-uem/openuem-server/releases/download/v0.8.0/openuem-server.exe"
+			data.DownloadHash = ""
+		}, wantErr: "SHA-256"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := UpdateRequest{}
+			data.Version = "0.8.0"
+			data.Channel = "stable"
+			data.UpdateNow = true
+			if runtime.GOOS == "windows" {
+				data.DownloadFrom = "https://github.com/open-uem/openuem-server/releases/download/v0.8.0/openuem-server.exe"
+			}
+			data.DownloadHash = strings.Repeat("a", 64)
+			tt.request(&data)
+
+			_, err := us.ValidateUpdateRequest(data)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidateUpdateRequest() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateUpdateRequest() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/open-uem/ent/server"
+)
+
+// SemVer is a semantic version, build metadata is ignored as it doesn't
+// affect precedence
+type SemVer struct {
+	Major      int
+	Minor      int
+	Patch      int
+	Prerelease string
+}
+
+func ParseSemVer(version string) (SemVer, error) {
+	v := SemVer{}
+
+	if !strictVersionRegexp.MatchString(version) {
+		return v, fmt.Errorf("%q is not a semantic version", version)
+	}
+
+	version, _, _ = strings.Cut(version, "+")
+	version, v.Prerelease, _ = strings.Cut(version, "-")
+
+	parts := strings.Split(version, ".")
+	v.Major, _ = strconv.Atoi(parts[0])
+	v.Minor, _ = strconv.Atoi(parts[1])
+	v.Patch, _ = strconv.Atoi(parts[2])
+	return v, nil
+}
+
+// Compare returns -1, 0 or 1 if v is lower, equal or greater than o
+// following the semantic versioning precedence rules
+func (v SemVer) Compare(o SemVer) int {
+	for _, c := range [][2]int{{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}} {
+		if c[0] != c[1] {
+			return compareInts(c[0], c[1])
+		}
+	}
+
+	// A pre-release has lower precedence than its release
+	switch {
+	case v.Prerelease == o.Prerelease:
+		return 0
+	case v.Prerelease == "":
+		return 1
+	case o.Prerelease == "":
+		return -1
+	}
+
+	a := strings.Split(v.Prerelease, ".")
+	b := strings.Split(o.Prerelease, ".")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+
+		x, errX := strconv.Atoi(a[i])
+		y, errY := strconv.Atoi(b[i])
+		switch {
+		case errX == nil && errY == nil:
+			return compareInts(x, y)
+		case errX == nil:
+			return -1
+		case errY == nil:
+			return 1
+		default:
+			return strings.Compare(a[i], b[i])
+		}
+	}
+	return compareInts(len(a), len(b))
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// matchesVersion reports if a repository version, that may carry a release
+// suffix like 0.8.0-1, is the version requested
+func matchesVersion(repoVersion string, version string) bool {
+	return repoVersion == version || strings.HasPrefix(repoVersion, version+"-")
+}
+
+// CheckVersionPolicy compares the requested version with the installed one
+// and returns why the update is allowed or an error if it's refused
+func (us *UpdaterService) CheckVersionPolicy(data UpdateRequest, channel server.Channel) (string, error) {
+	return checkVersionPolicy(data.Version, us.Version, data, channel)
+}
+
+// checkVersionPolicy applies the version policy to a version, the release
+// version or the version of a package in a release manifest, using the
+// overrides of the request
+func checkVersionPolicy(version string, installedVersion string, data UpdateRequest, channel server.Channel) (string, error) {
+	requested, err := ParseSemVer(version)
+	if err != nil {
+		return "", err
+	}
+
+	if requested.Prerelease != "" && channel == server.ChannelStable && !data.AllowPrerelease {
+		return "", fmt.Errorf("%s is a pre-release version and the server uses the stable channel, allow_prerelease is required", version)
+	}
+
+	installed, err := ParseSemVer(installedVersion)
+	if err != nil {
+		return fmt.Sprintf("installed version %q is unknown, update to %s allowed", installedVersion, version), nil
+	}
+
+	reason := fmt.Sprintf("update from %s to %s allowed", installedVersion, version)
+	overrides := []string{}
+
+	switch requested.Compare(installed) {
+	case -1:
+		if !data.AllowDowngrade {
+			return "", fmt.Errorf("%s is older than the installed version %s, allow_downgrade is required", version, installedVersion)
+		}
+		reason = fmt.Sprintf("downgrade from %s to %s allowed", installedVersion, version)
+		overrides = append(overrides, "allow_downgrade")
+	case 0:
+		reason = fmt.Sprintf("reinstall of %s allowed", version)
+	}
+
+	if requested.Major > installed.Major+1 {
+		if !data.AllowMajorSkip {
+			return "", fmt.Errorf("update from %s to %s skips major versions, allow_major_skip is required", installedVersion, version)
+		}
+		overrides = append(overrides, "allow_major_skip")
+	}
+
+	if requested.Prerelease != "" && channel == server.ChannelStable {
+		overrides = append(overrides, "allow_prerelease")
+	}
+
+	if len(overrides) > 0 {
+		reason += " by " + strings.Join(overrides, ", ")
+	}
+	return reason, nil
+}
+
+// ApplyVersionPolicy records the decision of the version policy in the server
+// row and terminates the request if it's refused. It returns true if the
+// update can go on
+func (us *UpdaterService) ApplyVersionPolicy(data UpdateRequest, msg jetstream.Msg, channel server.Channel) bool {
+	reason, err := us.CheckVersionPolicy(data, channel)
+	if err != nil {
+		log.Printf("[ERROR]: update refused by the version policy, reason: %v", err)
+
+		if err := msg.Term(); err != nil {
+			log.Printf("[ERROR]: could not terminate message, reason: %v", err)
+		}
+
+		if us.Model != nil {
+			historyID := us.StartUpdateHistory(data, channel)
+			us.SetUpdateStatus(historyID, us.Version, channel, server.UpdateStatusError, "version policy: update refused, "+err.Error(), time.Now())
+		} else {
+			us.PublishUpdateEvent(UpdatePhaseFailed, data.Version, channel, "version policy: update refused, "+err.Error())
+		}
+		return false
+	}
+
+	log.Printf("[INFO]: version policy: %s", reason)
+	if us.Model != nil {
+		if err := us.Model.SetServerUpdateMessage("version policy: " + reason); err != nil {
+			log.Printf("[ERROR]: could not save server status, reason: %v", err)
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/open-uem/ent/server"
+)
+
+func TestParseSemVer(t *testing.T) {
+	tests := []struct {
+		version string
+		want    SemVer
+		wantErr bool
+	}{
+		{version: "0.8.0", want: SemVer{Minor: 8}},
+		{version: "1.2.3-rc.1", want: SemVer{Major: 1, Minor: 2, Patch: 3, Prerelease: "rc.1"}},
+		{version: "1.2.3+build.5", want: SemVer{Major: 1, Minor: 2, Patch: 3}},
+		{version: "1.2", wantErr: true},
+		{version: "latest", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, err := ParseSemVer(tt.version)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSemVer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("ParseSemVer() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSemVerCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "0.8.0", b: "0.8.0", want: 0},
+		{a: "0.8.1", b: "0.8.0", want: 1},
+		{a: "0.9.0", b: "0.10.0", want: -1},
+		{a: "2.0.0", b: "1.9.9", want: 1},
+		{a: "1.0.0-rc.1", b: "1.0.0", want: -1},
+		{a: "1.0.0-rc.2", b: "1.0.0-rc.10", want: -1},
+		{a: "1.0.0-alpha", b: "1.0.0-1", want: 1},
+		{a: "1.0.0-beta", b: "1.0.0-alpha", want: 1},
+		{a: "1.0.0-rc", b: "1.0.0-rc.1", want: -1},
+		{a: "1.0.0+build.1", b: "1.0.0+build.2", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+"_"+tt.b, func(t *testing.T) {
+			a, err := ParseSemVer(tt.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ParseSemVer(tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := a.Compare(b); got != tt.want {
+				t.Errorf("Compare() = %d, want %d", got, tt.want)
+			}
+			if got := b.Compare(a); got != -tt.want {
+				t.Errorf("reverse Compare() = %d, want %d", got, -tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckVersionPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		installed string
+		version   string
+		channel   server.Channel
+		request   UpdateRequest
+		wantErr   bool
+	}{
+		{name: "upgrade", installed: "0.7.0", version: "0.8.0", channel: server.ChannelStable},
+		{name: "reinstall", installed: "0.8.0", version: "0.8.0", channel: server.ChannelStable},
+		{name: "unknown installed version", installed: "", version: "0.8.0", channel: server.ChannelStable},
+		{name: "downgrade refused", installed: "0.8.0", version: "0.7.0", channel: server.ChannelStable, wantErr: true},
+		{name: "downgrade allowed", installed: "0.8.0", version: "0.7.0", channel: server.ChannelStable, request: UpdateRequest{AllowDowngrade: true}},
+		{name: "major skip refused", installed: "1.0.0", version: "3.0.0", channel: server.ChannelStable, wantErr: true},
+		{name: "major skip allowed", installed: "1.0.0", version: "3.0.0", channel: server.ChannelStable, request: UpdateRequest{AllowMajorSkip: true}},
+		{name: "next major", installed: "1.4.0", version: "2.0.0", channel: server.ChannelStable},
+		{name: "pre-release on stable refused", installed: "0.8.0", version: "0.9.0-rc.1", channel: server.ChannelStable, wantErr: true},
+		{name: "pre-release on stable allowed", installed: "0.8.0", version: "0.9.0-rc.1", channel: server.ChannelStable, request: UpdateRequest{AllowPrerelease: true}},
+		{name: "pre-release on testing", installed: "0.8.0", version: "0.9.0-rc.1", channel: server.ChannelTesting},
+		{name: "invalid version", installed: "0.8.0", version: "next", channel: server.ChannelStable, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us := &UpdaterService{Version: tt.installed}
+			tt.request.Version = tt.version
+
+			reason, err := us.CheckVersionPolicy(tt.request, tt.channel)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckVersionPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && reason == "" {
+				t.Error("CheckVersionPolicy() allowed the update without a reason")
+			}
+		})
+	}
+}
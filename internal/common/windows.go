@@ -3,17 +3,19 @@
 package common
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/go-co-op/gocron/v2"
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/open-uem/ent/server"
-	openuem_nats "github.com/open-uem/nats"
 	"github.com/open-uem/utils"
+	"golang.org/x/sys/windows"
 	"gopkg.in/ini.v1"
 )
 
@@ -118,6 +120,22 @@ func (us *UpdaterService) ReadConfig() error {
 		log.Fatalf("[FATAL]: could not get current working directory")
 	}
 
+	us.ReadBackupConfig(cfg, filepath.Join(cwd, "backups"))
+	us.ReadHealthConfig(cfg)
+	us.ReadPreflightConfig(cfg)
+	us.ReadClusterConfig(cfg)
+	us.ReadValidationConfig(cfg)
+
+	if err := us.ReadMaintenanceConfig(cfg); err != nil {
+		log.Printf("[ERROR]: %v", err)
+		return err
+	}
+
+	if err := us.ReadUpdatesConfig(cfg); err != nil {
+		log.Printf("[ERROR]: %v", err)
+		return err
+	}
+
 	us.UpdaterCert = filepath.Join(cwd, "certificates", "updater", "updater.cer")
 	_, err = utils.ReadPEMCertificate(us.UpdaterCert)
 	if err != nil {
@@ -136,43 +154,106 @@ func (us *UpdaterService) ReadConfig() error {
 		log.Fatalf("[FATAL]: could not read CA certificate")
 	}
 
+	if err := us.ReadSecurityConfig(cfg); err != nil {
+		log.Printf("[ERROR]: %v", err)
+		return err
+	}
+
 	return nil
 }
 
-func (us *UpdaterService) ExecuteUpdate(data openuem_nats.OpenUEMUpdateRequest, msg jetstream.Msg, version string, channel server.Channel) {
-	// Download the file
+// WINDOWS_DOWNLOAD_RETRY_DELAY is how long an update waits to download the
+// installer again
+const WINDOWS_DOWNLOAD_RETRY_DELAY = 60 * time.Minute
+
+func (us *UpdaterService) ExecuteUpdate(data UpdateRequest, msg jetstream.Msg, version string, channel server.Channel) {
+	// Retried and restored updates may start outside the maintenance windows
+	if !us.CheckMaintenanceWindow(data, msg, channel) {
+		return
+	}
+
+	if !us.RunPreflight(data, msg, channel) {
+		return
+	}
+
+	// Rolling updates wait for a free update slot
+	if !us.AcquireUpdateLease(data, msg, channel) {
+		return
+	}
+
+	// A clustered NATS node can only be restarted if JetStream keeps its
+	// quorum, the leaderships are moved once this server holds the slot
+	if !us.PrepareNATSUpdate(data, msg, channel) {
+		return
+	}
+
+	// Nothing has been installed if the update is aborted before the installer
+	// is scheduled, so the update slot is released for the next server
 	cwd, err := utils.GetWd()
 	if err != nil {
 		log.Printf("[ERROR]: could not get working directory, reason %v", err)
+		us.ReleaseUpdateLease()
 
-		if err := msg.Ack(); err != nil {
-			log.Printf("[ERROR]: could not ACK message, reason: %v", err)
-			return
+		if msg != nil {
+			if err := msg.Ack(); err != nil {
+				log.Printf("[ERROR]: could not ACK message, reason: %v", err)
+				return
+			}
 		}
 
-		if err := us.Model.UpdateServerStatus(data.Version, channel, server.UpdateStatusError, fmt.Sprintf("could not get working directory, reason: %v", err), time.Now()); err != nil {
-			log.Printf("[ERROR]: could not save server status, reason: %v", err)
-		}
+		historyID := us.StartUpdateHistory(data, channel)
+		us.SetUpdateStatus(historyID, data.Version, channel, server.UpdateStatusError, fmt.Sprintf("could not get working directory, reason: %v", err), time.Now())
 		return
 	}
 
+	// Download the file
 	downloadPath := filepath.Join(cwd, "updates", "server-setup.exe")
 	if err := utils.DownloadFile(data.DownloadFrom, downloadPath, data.DownloadHash); err != nil {
 		log.Printf("[ERROR]: could not download update to directory, reason %v", err)
-		msg.NakWithDelay(60 * time.Minute)
-		if err := us.Model.UpdateServerStatus(data.Version, channel, server.UpdateStatusError, fmt.Sprintf("could not download update to directory, reason: %v", err), time.Now()); err != nil {
-			log.Printf("[ERROR]: could not save server status, reason: %v", err)
+		us.ReleaseUpdateLease()
+		if err := us.RetryUpdate(data, msg, channel, WINDOWS_DOWNLOAD_RETRY_DELAY); err != nil {
+			log.Printf("[ERROR]: could not retry the update, reason: %v", err)
 		}
+
+		// The update is pending until a download succeeds, so retries don't
+		// add a history entry each time
+		message := fmt.Sprintf("could not download update to directory, update will be retried in %s: %v", WINDOWS_DOWNLOAD_RETRY_DELAY, err)
+		us.SetUpdateStatus(0, us.Version, channel, server.UpdateStatusPending, message, time.Now().Add(WINDOWS_DOWNLOAD_RETRY_DELAY))
+		us.PublishUpdateEvent(UpdatePhaseScheduled, data.Version, channel, message)
 		return
 	}
 
-	if err := msg.Ack(); err != nil {
-		log.Printf("[ERROR]: could not ACK message, reason: %v", err)
+	// Scheduled updates were acknowledged once stored
+	if msg != nil {
+		if err := msg.Ack(); err != nil {
+			log.Printf("[ERROR]: could not ACK message, reason: %v", err)
+		}
 	}
 
-	if err := us.Model.UpdateServerStatus(data.Version, channel, server.UpdateStatusInProgress, "", time.Now()); err != nil {
-		log.Printf("[ERROR]: could not save server status, reason: %v", err)
+	historyID := us.StartUpdateHistory(data, channel)
+	us.SetUpdateStatus(historyID, data.Version, channel, server.UpdateStatusInProgress, "", time.Now())
+	us.PublishUpdateEvent(UpdatePhaseStarted, data.Version, channel, "")
+
+	if us.BackupEnabled {
+		if _, err := us.BackupDatabase(version); err != nil {
+			log.Printf("[ERROR]: update aborted, could not back up the database, reason: %v", err)
+			us.ReleaseUpdateLease()
+			us.SetUpdateStatus(historyID, data.Version, channel, server.UpdateStatusError, fmt.Sprintf("update aborted, could not back up the database, reason: %v", err), time.Now())
+			return
+		}
+	}
+
+	state := UpdateState{HistoryID: historyID, Version: version, Channel: channel, StartedAt: time.Now(), PreviousVersion: us.Version}
+	if plan, err := us.ReleasePlan(data); err != nil {
+		log.Printf("[ERROR]: migration levels won't be saved, reason: %v", err)
+	} else if plan != nil {
+		state.MigrationLevels = plan.MigrationLevels
 	}
+	if err := SaveUpdateState(&state); err != nil {
+		log.Printf("[ERROR]: could not save update state, reason: %v", err)
+	}
+
+	us.PublishUpdateEvent(UpdatePhasePackageManager, data.Version, channel, "installer has been scheduled")
 
 	cmd := exec.Command("schtasks.exe", "/DELETE", "/TN", "Update OpenUEM Server", "/F")
 	if err := cmd.Run(); err != nil {
@@ -193,5 +274,125 @@ func (us *UpdaterService) ExecuteUpdate(data openuem_nats.OpenUEMUpdateRequest,
 	)
 	if err := cmd.Run(); err != nil {
 		log.Printf("[ERROR]: could not run %s command, reason: %v", fmt.Sprintf("timeout /t 10 >NUL && \"%s\" /VERYSILENT", downloadPath), err)
+		RemoveUpdateState()
+		us.ReleaseUpdateLease()
+		us.SetUpdateStatus(historyID, data.Version, channel, server.UpdateStatusError, fmt.Sprintf("could not schedule the installer, reason: %v", err), time.Now())
+	}
+}
+
+// Rollback is not available on Windows as the installer replaces every component
+func (us *UpdaterService) Rollback(state *UpdateState, reason string) error {
+	return fmt.Errorf("rollback is not supported on Windows")
+}
+
+func UpdateStateFile() string {
+	cwd, err := utils.GetWd()
+	if err != nil {
+		return filepath.Join("updates", "update-state.json")
+	}
+	return filepath.Join(cwd, "updates", "update-state.json")
+}
+
+func UpdateLogDirectory() string {
+	cwd, err := utils.GetWd()
+	if err != nil {
+		return filepath.Join("logs", "updates")
+	}
+	return filepath.Join(cwd, "logs", "updates")
+}
+
+// ServiceActive returns an error if the Windows service is not running
+func ServiceActive(service string) error {
+	out, err := exec.Command("sc.exe", "query", service).Output()
+	if err != nil {
+		return fmt.Errorf("could not query service, reason: %v", err)
+	}
+	if !strings.Contains(string(out), "RUNNING") {
+		return fmt.Errorf("not running")
+	}
+	return nil
+}
+
+// ComponentVersion returns the version written by the installer as it
+// installs every component with the same version
+func (us *UpdaterService) ComponentVersion(c Component) (string, error) {
+	return us.Version, nil
+}
+
+// InstalledPackageVersions returns the version of every component installed,
+// there's no package database on Windows so we use the installer's version
+func (us *UpdaterService) InstalledPackageVersions() (map[string]string, error) {
+	versions := map[string]string{}
+	for _, c := range us.InstalledOpenUEMComponents() {
+		versions[c.Package] = us.Version
+	}
+	return versions, nil
+}
+
+// RunnerState is not used on Windows, the installer is run by the task scheduler
+type RunnerState struct {
+	ExitCode int
+	Error    string
+}
+
+func RemoveRunnerState() {}
+
+// WaitForRunner returns immediately as there's no update runner on Windows
+func WaitForRunner(state *UpdateState) (*RunnerState, error) {
+	return nil, nil
+}
+
+// InstalledUpdatePackages returns the version of every component as the
+// installer updates all of them
+func (us *UpdaterService) InstalledUpdatePackages() (map[string]string, error) {
+	return us.InstalledPackageVersions()
+}
+
+// ManifestFamily returns the key of the release manifest packages for Windows
+func ManifestFamily() (string, error) {
+	return "windows", nil
+}
+
+// DryRun is not available on Windows as the installer can't simulate an update
+func (us *UpdaterService) DryRun(data UpdateRequest) *DryRunReport {
+	return &DryRunReport{Version: data.Version, Channel: data.Channel, Error: "dry run is not supported on Windows"}
+}
+
+// PlatformPreflightChecks checks disk space and that the task scheduler is available
+func (us *UpdaterService) PlatformPreflightChecks(data UpdateRequest) []PreflightFailure {
+	failures := []PreflightFailure{}
+
+	cwd, err := utils.GetWd()
+	if err != nil {
+		return append(failures, PreflightFailure{Check: "disk space", Reason: fmt.Sprintf("could not get working directory, reason: %v", err)})
 	}
+
+	var free uint64
+	path, err := windows.UTF16PtrFromString(cwd)
+	if err == nil {
+		err = windows.GetDiskFreeSpaceEx(path, &free, nil, nil)
+	}
+	if err != nil {
+		failures = append(failures, PreflightFailure{Check: "disk space", Reason: fmt.Sprintf("could not check %s, reason: %v", cwd, err)})
+	} else if free/1024/1024 < us.PreflightMinFreeMB {
+		failures = append(failures, PreflightFailure{Check: "disk space", Reason: fmt.Sprintf("%s has %d MB free, %d MB required", cwd, free/1024/1024, us.PreflightMinFreeMB), Transient: true})
+	}
+
+	if _, err := exec.LookPath("schtasks.exe"); err != nil {
+		failures = append(failures, PreflightFailure{Check: "runner", Reason: "schtasks.exe is not available"})
+	}
+
+	return failures
+}
+
+// SwitchRepositoryChannel does nothing on Windows as the installer is
+// downloaded from the URL in the update request
+func (us *UpdaterService) SwitchRepositoryChannel(from server.Channel, to server.Channel) (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+// RepositoryLatestVersion is not supported on Windows as there's no
+// repository, the release manifest URL must be set to check for new versions
+func (us *UpdaterService) RepositoryLatestVersion() (string, error) {
+	return "", errors.New("the release manifest URL is required to check for new versions on Windows")
 }
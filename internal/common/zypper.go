@@ -0,0 +1,120 @@
+//go:build linux
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ZypperPackageManager installs OpenUEM on SUSE and openSUSE, packages are
+// the same rpm packages that we use with dnf
+type ZypperPackageManager struct{}
+
+func (pm *ZypperPackageManager) Name() string {
+	return "zypper"
+}
+
+func (pm *ZypperPackageManager) InstalledComponents() []string {
+	return installedOpenUEMPackages()
+}
+
+func (pm *ZypperPackageManager) IsVersionAvailable(name string, version string) (bool, error) {
+	out, err := runQuery("zypper", "--non-interactive", "--quiet", "search", "--details", "--match-exact", name)
+	if err != nil {
+		return false, err
+	}
+
+	// Columns are S | Name | Type | Version | Arch | Repository
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) > 3 && matchesVersion(strings.TrimSpace(fields[3]), version) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (pm *ZypperPackageManager) Install(packages []Package, allowDowngrade bool, output io.Writer) error {
+	if err := runInstall(output, "zypper", "--non-interactive", "refresh"); err != nil {
+		return err
+	}
+
+	args := []string{"--non-interactive", "install"}
+	if allowDowngrade {
+		args = append(args, "--oldpackage")
+	}
+	for _, p := range packages {
+		args = append(args, fmt.Sprintf("%s=%s", p.Name, p.Version))
+	}
+	return runInstall(output, "zypper", args...)
+}
+
+func (pm *ZypperPackageManager) Simulate(packages []Package) (*Transaction, error) {
+	args := []string{"--non-interactive", "install", "--dry-run", "--oldpackage", "--details"}
+	for _, p := range packages {
+		args = append(args, fmt.Sprintf("%s=%s", p.Name, p.Version))
+	}
+
+	out, err := runSimulation("zypper", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	t := Transaction{}
+	for _, line := range strings.Split(out, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "Overall download size:"):
+			t.DownloadSize = strings.TrimSuffix(strings.TrimSpace(strings.TrimPrefix(trimmed, "Overall download size:")), ".")
+		case strings.HasPrefix(trimmed, "Problem:"), strings.HasPrefix(trimmed, "Solution "):
+			t.Conflicts = append(t.Conflicts, trimmed)
+		default:
+			// With --details changes are listed as name  from -> to
+			name, versions, found := strings.Cut(trimmed, "  ")
+			if !found || !strings.Contains(versions, "->") {
+				continue
+			}
+			from, to, _ := strings.Cut(versions, "->")
+			t.Packages = append(t.Packages, PackageChange{Name: strings.TrimSpace(name), From: strings.TrimSpace(from), To: strings.TrimSpace(to)})
+		}
+	}
+	fillPreviousVersions(pm, &t)
+
+	return &t, nil
+}
+
+func (pm *ZypperPackageManager) CheckLocks() error {
+	if err := pidFileLocked("/run/zypp.pid"); err != nil {
+		return err
+	}
+	return fcntlLocked("/var/lib/rpm/.rpm.lock")
+}
+
+func (pm *ZypperPackageManager) InstalledVersion(name string) (string, error) {
+	return runQuery("rpm", "-q", "--queryformat", "%{VERSION}", name)
+}
+
+func (pm *ZypperPackageManager) RepositoryFiles() []string {
+	return []string{"/etc/zypp/repos.d/openuem.repo"}
+}
+
+func (pm *ZypperPackageManager) Refresh(output io.Writer) error {
+	return runInstall(output, "zypper", "--non-interactive", "refresh")
+}
+
+func (pm *ZypperPackageManager) LatestVersion(name string) (string, error) {
+	out, err := runQuery("zypper", "--non-interactive", "--quiet", "info", name)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if found && strings.TrimSpace(key) == "Version" {
+			return withoutRelease(strings.TrimSpace(value)), nil
+		}
+	}
+	return "", fmt.Errorf("the repository doesn't offer %s", name)
+}
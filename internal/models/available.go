@@ -0,0 +1,58 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/open-uem/ent/server"
+)
+
+// AvailableVersion is the newest version offered to a server in its channel,
+// the console compares it with the installed version to show outdated servers.
+// DetectedAt is when the latest version was first seen
+type AvailableVersion struct {
+	Hostname         string
+	Channel          server.Channel
+	InstalledVersion string
+	LatestVersion    string
+	Source           string
+	CheckedAt        time.Time
+	DetectedAt       time.Time
+}
+
+func (m *Model) SetAvailableVersion(channel server.Channel, installed string, latest string, source string) error {
+	hostname, err := GetHostname()
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ExecContext(context.Background(), `
+		INSERT INTO server_available_versions (hostname, channel, installed_version, latest_version, source, checked_at, detected_at) VALUES ($1, $2, $3, $4, $5, $6, $6)
+		ON CONFLICT (hostname) DO UPDATE SET channel = EXCLUDED.channel, installed_version = EXCLUDED.installed_version,
+		latest_version = EXCLUDED.latest_version, source = EXCLUDED.source, checked_at = EXCLUDED.checked_at,
+		detected_at = CASE WHEN server_available_versions.latest_version = EXCLUDED.latest_version AND server_available_versions.detected_at IS NOT NULL
+		THEN server_available_versions.detected_at ELSE EXCLUDED.detected_at END`,
+		hostname, string(channel), installed, latest, source, time.Now())
+	return err
+}
+
+// GetAvailableVersion returns the last check for the server or nil if it was never checked
+func (m *Model) GetAvailableVersion(hostname string) (*AvailableVersion, error) {
+	var channel string
+	var detectedAt sql.NullTime
+
+	av := AvailableVersion{}
+	row := m.DB.QueryRowContext(context.Background(), `
+		SELECT hostname, channel, installed_version, latest_version, source, checked_at, detected_at FROM server_available_versions WHERE hostname = $1`, hostname)
+	if err := row.Scan(&av.Hostname, &channel, &av.InstalledVersion, &av.LatestVersion, &av.Source, &av.CheckedAt, &detectedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	av.Channel = server.Channel(channel)
+	av.DetectedAt = detectedAt.Time
+	return &av, nil
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+type ComponentVersions struct {
+	Hostname  string
+	Versions  map[string]string
+	Mixed     bool
+	CheckedAt time.Time
+}
+
+func (m *Model) SetComponentVersions(versions map[string]string, mixed bool) error {
+	hostname, err := GetHostname()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ExecContext(context.Background(), `
+		INSERT INTO server_component_versions (hostname, versions, mixed, checked_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (hostname) DO UPDATE SET versions = EXCLUDED.versions, mixed = EXCLUDED.mixed, checked_at = EXCLUDED.checked_at`,
+		hostname, data, mixed, time.Now())
+	return err
+}
+
+func (m *Model) GetComponentVersions(hostname string) (*ComponentVersions, error) {
+	var data []byte
+
+	cv := ComponentVersions{}
+	row := m.DB.QueryRowContext(context.Background(), `SELECT hostname, versions, mixed, checked_at FROM server_component_versions WHERE hostname = $1`, hostname)
+	if err := row.Scan(&cv.Hostname, &data, &cv.Mixed, &cv.CheckedAt); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &cv.Versions); err != nil {
+		return nil, err
+	}
+	return &cv, nil
+}
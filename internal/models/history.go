@@ -0,0 +1,101 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/open-uem/ent/server"
+)
+
+// UpdateHistoryStatusRolledBack is the status of an update that failed and
+// whose previous versions were reinstalled, it's not a server update status
+const UpdateHistoryStatusRolledBack = "Rolled Back"
+
+// UpdateHistoryStatusCancelled is the status of a scheduled update that was
+// cancelled before it started
+const UpdateHistoryStatusCancelled = "Cancelled"
+
+// UpdateHistoryStatusRejected is the status of a request that was rejected
+// because its signature couldn't be verified
+const UpdateHistoryStatusRejected = "Rejected"
+
+// UpdateHistory is an update attempt, rows are never updated once the attempt ends
+type UpdateHistory struct {
+	ID          int64
+	Hostname    string
+	Version     string
+	Channel     server.Channel
+	RequestedBy string
+	ScheduledAt time.Time
+	StartedAt   time.Time
+	EndedAt     time.Time
+	Status      string
+	Message     string
+	Output      string
+}
+
+const updateHistoryColumns = `id, hostname, version, channel, requested_by, scheduled_at, started_at, ended_at, status, message, output`
+
+func (m *Model) CreateUpdateHistory(version string, channel server.Channel, requestedBy string, scheduledAt time.Time, status string) (int64, error) {
+	var id int64
+
+	hostname, err := GetHostname()
+	if err != nil {
+		return 0, err
+	}
+
+	scheduled := sql.NullTime{Time: scheduledAt, Valid: !scheduledAt.IsZero()}
+
+	row := m.DB.QueryRowContext(context.Background(), `
+		INSERT INTO server_update_history (hostname, version, channel, requested_by, scheduled_at, started_at, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		hostname, version, string(channel), requestedBy, scheduled, time.Now(), status)
+	if err := row.Scan(&id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// FinishUpdateHistory records how an update attempt ended, an attempt can only be finished once
+func (m *Model) FinishUpdateHistory(id int64, status string, message string, output string) error {
+	_, err := m.DB.ExecContext(context.Background(), `
+		UPDATE server_update_history SET ended_at = $2, status = $3, message = $4, output = $5
+		WHERE id = $1 AND ended_at IS NULL`,
+		id, time.Now(), status, message, output)
+	return err
+}
+
+func (m *Model) GetUpdateHistoryByHost(hostname string) ([]UpdateHistory, error) {
+	return m.queryUpdateHistory(`SELECT `+updateHistoryColumns+` FROM server_update_history WHERE hostname = $1 ORDER BY started_at DESC`, hostname)
+}
+
+// GetUpdateHistoryBetween returns the attempts of every server started in the time range
+func (m *Model) GetUpdateHistoryBetween(from time.Time, to time.Time) ([]UpdateHistory, error) {
+	return m.queryUpdateHistory(`SELECT `+updateHistoryColumns+` FROM server_update_history WHERE started_at >= $1 AND started_at < $2 ORDER BY started_at DESC`, from, to)
+}
+
+func (m *Model) queryUpdateHistory(query string, args ...any) ([]UpdateHistory, error) {
+	rows, err := m.DB.QueryContext(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []UpdateHistory{}
+	for rows.Next() {
+		var scheduledAt, endedAt sql.NullTime
+		var channel string
+
+		h := UpdateHistory{}
+		if err := rows.Scan(&h.ID, &h.Hostname, &h.Version, &channel, &h.RequestedBy, &scheduledAt, &h.StartedAt, &endedAt, &h.Status, &h.Message, &h.Output); err != nil {
+			return nil, err
+		}
+		h.Channel = server.Channel(channel)
+		h.ScheduledAt = scheduledAt.Time
+		h.EndedAt = endedAt.Time
+		history = append(history, h)
+	}
+
+	return history, rows.Err()
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// SetMigrationLevel records the database migration level reached by a
+// component. The database is shared by every server so the level is not
+// per host and it never goes down
+func (m *Model) SetMigrationLevel(component string, level int, version string) error {
+	_, err := m.DB.ExecContext(context.Background(), `
+		INSERT INTO server_migration_levels (component, level, version, updated_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (component) DO UPDATE SET level = EXCLUDED.level, version = EXCLUDED.version, updated_at = EXCLUDED.updated_at
+		WHERE server_migration_levels.level < EXCLUDED.level`,
+		component, level, version, time.Now())
+	return err
+}
+
+// GetMigrationLevels returns the database migration level of every component
+func (m *Model) GetMigrationLevels() (map[string]int, error) {
+	rows, err := m.DB.QueryContext(context.Background(), `SELECT component, level FROM server_migration_levels`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	levels := map[string]int{}
+	for rows.Next() {
+		var component string
+		var level int
+		if err := rows.Scan(&component, &level); err != nil {
+			return nil, err
+		}
+		levels[component] = level
+	}
+	return levels, rows.Err()
+}
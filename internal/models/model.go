@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"strings"
 
 	"entgo.io/ent/dialect"
 	entsql "entgo.io/ent/dialect/sql"
@@ -14,6 +15,7 @@ import (
 
 type Model struct {
 	Client *ent.Client
+	DB     *sql.DB
 }
 
 func New(dbUrl string) (*Model, error) {
@@ -24,6 +26,7 @@ func New(dbUrl string) (*Model, error) {
 		return nil, fmt.Errorf("could not connect with Postgres database: %v", err)
 	}
 
+	model.DB = db
 	model.Client = ent.NewClient(ent.Driver(entsql.OpenDB(dialect.Postgres, db)))
 
 	// TODO Automatic migrations only in development
@@ -34,9 +37,27 @@ func New(dbUrl string) (*Model, error) {
 		}
 	}
 
+	// Tables owned by the updater that are not part of the ent schema
+	if err := model.createUpdaterTables(ctx); err != nil {
+		return nil, err
+	}
+
 	return &model, nil
 }
 
 func (m *Model) Close() {
 	m.Client.Close()
 }
+
+// GetHostname returns the hostname without the domain, the server is stored
+// with it and it's used in the NATS subjects
+func GetHostname() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+
+	// Fix #1 hostname must not contain dots and domain
+	hostnameParts := strings.Split(hostname, ".")
+	return hostnameParts[0], nil
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/open-uem/ent/server"
+)
+
+// ScheduledUpdate is an accepted update request waiting for its time, the
+// request is kept as JSON so the updater can rebuild its schedule on startup
+type ScheduledUpdate struct {
+	ID        int64
+	Hostname  string
+	Channel   server.Channel
+	Request   []byte
+	UpdateAt  time.Time
+	CreatedAt time.Time
+}
+
+// SaveScheduledUpdate stores an update request. The stream sequence of the
+// request message, if any, prevents storing a redelivered request twice, in
+// that case it returns false
+func (m *Model) SaveScheduledUpdate(channel server.Channel, request []byte, updateAt time.Time, streamSequence uint64) (int64, bool, error) {
+	var id int64
+
+	hostname, err := GetHostname()
+	if err != nil {
+		return 0, false, err
+	}
+
+	sequence := sql.NullInt64{Int64: int64(streamSequence), Valid: streamSequence != 0}
+
+	row := m.DB.QueryRowContext(context.Background(), `
+		INSERT INTO server_scheduled_updates (hostname, channel, request, update_at, stream_sequence, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (hostname, stream_sequence) DO NOTHING
+		RETURNING id`,
+		hostname, string(channel), string(request), updateAt, sequence, time.Now())
+	if err := row.Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return id, true, nil
+}
+
+// GetScheduledUpdates returns the updates scheduled for this server
+func (m *Model) GetScheduledUpdates() ([]ScheduledUpdate, error) {
+	hostname, err := GetHostname()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := m.DB.QueryContext(context.Background(), `
+		SELECT id, hostname, channel, request, update_at, created_at FROM server_scheduled_updates
+		WHERE hostname = $1 ORDER BY update_at`, hostname)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	updates := []ScheduledUpdate{}
+	for rows.Next() {
+		var channel string
+
+		u := ScheduledUpdate{}
+		if err := rows.Scan(&u.ID, &u.Hostname, &channel, &u.Request, &u.UpdateAt, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		u.Channel = server.Channel(channel)
+		updates = append(updates, u)
+	}
+
+	return updates, rows.Err()
+}
+
+// RescheduleUpdate moves a scheduled update to a new time
+func (m *Model) RescheduleUpdate(id int64, request []byte, updateAt time.Time) error {
+	_, err := m.DB.ExecContext(context.Background(), `UPDATE server_scheduled_updates SET request = $2, update_at = $3 WHERE id = $1`, id, string(request), updateAt)
+	return err
+}
+
+// DeleteScheduledUpdate removes a scheduled update once it starts or it's cancelled
+func (m *Model) DeleteScheduledUpdate(id int64) error {
+	_, err := m.DB.ExecContext(context.Background(), `DELETE FROM server_scheduled_updates WHERE id = $1`, id)
+	return err
+}
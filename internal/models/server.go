@@ -2,9 +2,8 @@ package models
 
 import (
 	"context"
-	"os"
+	"fmt"
 	"runtime"
-	"strings"
 	"time"
 
 	openuem_ent "github.com/open-uem/ent"
@@ -12,17 +11,14 @@ import (
 )
 
 func (m *Model) SetServer(version string, channel server.Channel) error {
-	hostname, err := os.Hostname()
+	hostname, err := GetHostname()
 	if err != nil {
 		return err
 	}
 
-	// Fix #1 hostname must not contain dots and domain
-	hostnameParts := strings.Split(hostname, ".")
-	hostname = hostnameParts[0]
-
+	// The server keeps its row when its channel changes
 	exists := true
-	s, err := m.Client.Server.Query().Where(server.Hostname(hostname), server.Arch(runtime.GOARCH), server.Os(runtime.GOOS), server.ChannelEQ(channel)).Only(context.Background())
+	s, err := serverQuery(m.Client, hostname).First(context.Background())
 	if err != nil {
 		if !openuem_ent.IsNotFound(err) {
 			return err
@@ -36,16 +32,26 @@ func (m *Model) SetServer(version string, channel server.Channel) error {
 	return m.Client.Server.Update().SetHostname(hostname).SetArch(runtime.GOARCH).SetOs(runtime.GOOS).SetVersion(version).SetChannel(channel).Where(server.ID(s.ID)).Exec(context.Background())
 }
 
-func (m *Model) UpdateServerStatus(version string, channel server.Channel, status server.UpdateStatus, message string, when time.Time) error {
-	hostname, err := os.Hostname()
+// serverQuery looks up the row of this server the way SetServer does, the
+// oldest row is used as rows left by channel changes may still exist
+func serverQuery(client *openuem_ent.Client, hostname string) *openuem_ent.ServerQuery {
+	return client.Server.Query().
+		Where(server.Hostname(hostname), server.Arch(runtime.GOARCH), server.Os(runtime.GOOS)).
+		Order(openuem_ent.Asc(server.FieldID))
+}
+
+// getServer returns the row of this server
+func (m *Model) getServer() (*openuem_ent.Server, error) {
+	hostname, err := GetHostname()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// Fix #1 hostname must not contain dots and domain
-	hostnameParts := strings.Split(hostname, ".")
-	hostname = hostnameParts[0]
 
-	s, err := m.Client.Server.Query().Where(server.Hostname(hostname), server.Arch(runtime.GOARCH), server.Os(runtime.GOOS), server.ChannelEQ(channel)).Only(context.Background())
+	return serverQuery(m.Client, hostname).First(context.Background())
+}
+
+func (m *Model) UpdateServerStatus(version string, status server.UpdateStatus, message string, when time.Time) error {
+	s, err := m.getServer()
 	if err != nil {
 		return err
 	}
@@ -64,18 +70,71 @@ func (m *Model) UpdateServerStatus(version string, channel server.Channel, statu
 }
 
 func (m *Model) GetServerStatus() (*openuem_ent.Server, error) {
-	hostname, err := os.Hostname()
+	return m.getServer()
+}
+
+// SetServerUpdateMessage saves a message for the server without changing its update status
+func (m *Model) SetServerUpdateMessage(message string) error {
+	s, err := m.getServer()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	// Fix #1 hostname must not contain dots and domain
-	hostnameParts := strings.Split(hostname, ".")
-	hostname = hostnameParts[0]
 
-	server, err := m.Client.Server.Query().Where(server.Hostname(hostname)).Only(context.Background())
+	return m.Client.Server.UpdateOneID(s.ID).
+		SetUpdateMessage(message).
+		Exec(context.Background())
+}
+
+// ClearServerUpdateStatus removes the update status of the server and saves
+// the installed version, used when a pending update is cancelled and there's
+// no update going on
+func (m *Model) ClearServerUpdateStatus(version string, message string) error {
+	s, err := m.getServer()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	return m.Client.Server.UpdateOneID(s.ID).
+		SetVersion(version).
+		ClearUpdateStatus().
+		ClearUpdateWhen().
+		SetUpdateMessage(message).
+		Exec(context.Background())
+}
+
+// MoveServerChannel moves the server row to another channel, rows left by
+// previous channel changes for the same server are removed
+func (m *Model) MoveServerChannel(to server.Channel) error {
+	hostname, err := GetHostname()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	tx, err := m.Client.Tx(ctx)
+	if err != nil {
+		return err
 	}
 
-	return server, nil
+	s, err := serverQuery(tx.Client(), hostname).First(ctx)
+	if err != nil {
+		return rollback(tx, err)
+	}
+
+	if _, err := tx.Server.Delete().Where(server.Hostname(hostname), server.Arch(runtime.GOARCH), server.Os(runtime.GOOS), server.IDNEQ(s.ID)).Exec(ctx); err != nil {
+		return rollback(tx, err)
+	}
+
+	if err := tx.Server.UpdateOneID(s.ID).SetChannel(to).Exec(ctx); err != nil {
+		return rollback(tx, err)
+	}
+
+	return tx.Commit()
+}
+
+func rollback(tx *openuem_ent.Tx, err error) error {
+	if rerr := tx.Rollback(); rerr != nil {
+		return fmt.Errorf("%w: %v", err, rerr)
+	}
+	return err
 }
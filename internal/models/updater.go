@@ -0,0 +1,67 @@
+package models
+
+import (
+	"context"
+	"fmt"
+)
+
+// updaterTables are created by the updater as they are only used by
+// the updater and the console reads them to show the updater's state
+var updaterTables = []string{
+	`CREATE TABLE IF NOT EXISTS server_component_versions (
+		hostname TEXT PRIMARY KEY,
+		versions JSONB NOT NULL,
+		mixed BOOLEAN NOT NULL DEFAULT FALSE,
+		checked_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS server_update_history (
+		id BIGSERIAL PRIMARY KEY,
+		hostname TEXT NOT NULL,
+		version TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		requested_by TEXT NOT NULL DEFAULT '',
+		scheduled_at TIMESTAMPTZ,
+		started_at TIMESTAMPTZ NOT NULL,
+		ended_at TIMESTAMPTZ,
+		status TEXT NOT NULL,
+		message TEXT NOT NULL DEFAULT '',
+		output TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS server_update_history_hostname_started_at ON server_update_history (hostname, started_at)`,
+	`CREATE TABLE IF NOT EXISTS server_scheduled_updates (
+		id BIGSERIAL PRIMARY KEY,
+		hostname TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		request JSONB NOT NULL,
+		update_at TIMESTAMPTZ NOT NULL,
+		stream_sequence BIGINT,
+		created_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS server_scheduled_updates_hostname_stream_sequence ON server_scheduled_updates (hostname, stream_sequence)`,
+	`CREATE TABLE IF NOT EXISTS server_available_versions (
+		hostname TEXT PRIMARY KEY,
+		channel TEXT NOT NULL,
+		installed_version TEXT NOT NULL DEFAULT '',
+		latest_version TEXT NOT NULL,
+		source TEXT NOT NULL,
+		checked_at TIMESTAMPTZ NOT NULL,
+		detected_at TIMESTAMPTZ
+	)`,
+	// Tables created before detected_at was added
+	`ALTER TABLE server_available_versions ADD COLUMN IF NOT EXISTS detected_at TIMESTAMPTZ`,
+	`CREATE TABLE IF NOT EXISTS server_migration_levels (
+		component TEXT PRIMARY KEY,
+		level INTEGER NOT NULL,
+		version TEXT NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL
+	)`,
+}
+
+func (m *Model) createUpdaterTables(ctx context.Context) error {
+	for _, table := range updaterTables {
+		if _, err := m.DB.ExecContext(ctx, table); err != nil {
+			return fmt.Errorf("could not create updater table, reason: %v", err)
+		}
+	}
+	return nil
+}
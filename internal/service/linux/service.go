@@ -12,6 +12,17 @@ import (
 )
 
 func main() {
+	// Run the package manager as the detached update runner
+	if len(os.Args) > 1 && os.Args[1] == "run-update" {
+		os.Exit(common.RunUpdate())
+	}
+
+	// Restore a database backup from the command line: restore [file]
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		restore(os.Args[2:])
+		return
+	}
+
 	us, err := common.NewUpdateService()
 	if err != nil {
 		log.Fatalf("[FATAL]: could not create task scheduler, reason: %s", err.Error())
@@ -34,3 +45,21 @@ func main() {
 
 	us.StopService()
 }
+
+func restore(args []string) {
+	us := common.UpdaterService{}
+	if err := us.ReadConfig(); err != nil {
+		log.Fatalf("[FATAL]: could not read config, reason: %v", err)
+	}
+
+	file := ""
+	if len(args) > 0 {
+		file = args[0]
+	}
+
+	restored, err := us.RestoreBackup(file)
+	if err != nil {
+		log.Fatalf("[FATAL]: could not restore backup, reason: %v", err)
+	}
+	log.Printf("[INFO]: backup %s has been restored", restored)
+}
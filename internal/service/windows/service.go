@@ -4,6 +4,7 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/open-uem/openuem-server-updater/internal/common"
 	"github.com/open-uem/utils"
@@ -11,6 +12,12 @@ import (
 )
 
 func main() {
+	// Restore a database backup from the command line: restore [file]
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		restore(os.Args[2:])
+		return
+	}
+
 	us, err := common.NewUpdateService()
 	if err != nil {
 		log.Fatalf("[FATAL]: could not create task scheduler, reason: %s", err.Error())
@@ -33,3 +40,21 @@ func main() {
 		log.Printf("[ERROR]: could not run service: %v", err)
 	}
 }
+
+func restore(args []string) {
+	us := common.UpdaterService{}
+	if err := us.ReadConfig(); err != nil {
+		log.Fatalf("[FATAL]: could not read config, reason: %v", err)
+	}
+
+	file := ""
+	if len(args) > 0 {
+		file = args[0]
+	}
+
+	restored, err := us.RestoreBackup(file)
+	if err != nil {
+		log.Fatalf("[FATAL]: could not restore backup, reason: %v", err)
+	}
+	log.Printf("[INFO]: backup %s has been restored", restored)
+}